@@ -0,0 +1,184 @@
+package elmproxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+type contextKey string
+
+const actorKey contextKey = "actor"
+
+// Admin credentials, configured under credentials.admins
+//
+type AdminToken struct {
+	Name  string `mapstructure:"name"`
+	Token string `mapstructure:"token"`
+}
+
+// Requires a configured admin bearer token, the name of the matching
+// admin is available to the handler through requestActor.
+//
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return tokenOnly("credentials.admins", h)
+}
+
+// Requires a bearer token matching one of the AdminToken entries under key
+//
+func tokenOnly(key string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		actor, ok, err := tokenActor(key, r)
+		if err != nil {
+			log.Error(err.Error())
+			http.Error(w, "Server Error.", 500)
+			return
+		}
+		if !ok {
+			http.Error(w, "Unauthorized.", 401)
+			return
+		}
+		h(w, withActor(r, actor))
+	}
+}
+
+// Name of the AdminToken entry under key matching the request's bearer token
+//
+func tokenActor(key string, r *http.Request) (string, bool, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	var tokens []AdminToken
+	if err := viper.UnmarshalKey(key, &tokens); err != nil {
+		return "", false, fmt.Errorf("Invalid %s %w", key, err)
+	}
+	for _, t := range tokens {
+		if t.Token != "" && subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+			return t.Name, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+func withActor(r *http.Request, actor string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), actorKey, actor))
+}
+
+func writeJson(w http.ResponseWriter, v interface{}) {
+	writeJsonStatus(w, 200, v)
+}
+
+// Headers must be set before the status is written
+//
+func writeJsonStatus(w http.ResponseWriter, code int, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(b)
+}
+
+func requestActor(r *http.Request) string {
+	if actor, ok := r.Context().Value(actorKey).(string); ok {
+		return actor
+	}
+	return ""
+}
+
+// Looks up the private package addressed by the group, name & version route variables
+//
+func routePrivatePackage(w http.ResponseWriter, r *http.Request) *Package {
+	vars := mux.Vars(r)
+	pkg, err := Packages.GetPackage(vars["group"]+"/"+vars["name"], vars["version"])
+	if err != nil {
+		if err == gorm.ErrRecordNotFound {
+			http.Error(w, "Package not found.", 404)
+		} else {
+			log.Error(err.Error())
+			http.Error(w, "Server Error.", 500)
+		}
+		return nil
+	}
+	if !pkg.Private {
+		http.Error(w, "Only private packages can be modified.", 400)
+		return nil
+	}
+	return pkg
+}
+
+func yankPackage(w http.ResponseWriter, r *http.Request) {
+	pkg := routePrivatePackage(w, r)
+	if pkg == nil {
+		return
+	}
+	before := newEventPackage(pkg)
+	pkg.Yanked = true
+	if _, err := Packages.UpdatePackage(pkg); err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	log.Infof("%s yanked %s@%s", requestActor(r), pkg.Name, pkg.Version)
+	audit(r, AuditYank, packageSubject(pkg), before, map[string]bool{"yanked": true})
+	emit(EventYanked, pkg)
+	w.WriteHeader(204)
+}
+
+func deletePackage(w http.ResponseWriter, r *http.Request) {
+	pkg := routePrivatePackage(w, r)
+	if pkg == nil {
+		return
+	}
+	if err := Packages.DeletePackage(pkg); err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	if err := removePackageFiles(pkg.Name, pkg.Version); err != nil {
+		log.Errorf("Failed removing files of %s@%s: %s", pkg.Name, pkg.Version, err)
+	}
+	log.Infof("%s deleted %s@%s", requestActor(r), pkg.Name, pkg.Version)
+	audit(r, AuditDelete, packageSubject(pkg), newEventPackage(pkg), nil)
+	emit(EventDeleted, pkg)
+	w.WriteHeader(204)
+}
+
+func namespaces(w http.ResponseWriter, r *http.Request) {
+	ns, err := Packages.GetPrivatePackageNamespaces()
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	writeJson(w, ns)
+}
+
+func createNamespace(w http.ResponseWriter, r *http.Request) {
+	ns := PrivateNamespace{}
+	if err := json.NewDecoder(r.Body).Decode(&ns); err != nil || ns.Name == "" || strings.Contains(ns.Name, "/") {
+		http.Error(w, "Invalid namespace", 400)
+		return
+	}
+	if _, err := Packages.GetPrivatePackageNamespace(ns.Name); err == nil {
+		http.Error(w, "Namespace already exists.", 400)
+		return
+	}
+	created, err := Packages.CreatePrivatePackageNamespace(ns.Name)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	audit(r, AuditNamespaceCreate, created.Name, nil, created)
+	writeJsonStatus(w, 201, created)
+}
@@ -0,0 +1,25 @@
+package elmproxy
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCreateNamespaceResponse(t *testing.T) {
+	openTestStore(t, "http://127.0.0.1:1")
+	rec := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/admin/namespaces", strings.NewReader(`{"name": "acme"}`))
+	createNamespace(rec, withActor(r, "alice"))
+	if rec.Code != 201 {
+		t.Fatalf("created a namespace with status %d, want 201", rec.Code)
+	}
+	if ct := rec.Result().Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("created namespace served as %q", ct)
+	}
+	var ns PrivateNamespace
+	if err := json.Unmarshal(rec.Body.Bytes(), &ns); err != nil || ns.Name != "acme" {
+		t.Errorf("created namespace %s (%v)", rec.Body, err)
+	}
+}
@@ -0,0 +1,201 @@
+package elmproxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Recorded approval or rejection of a pending package
+//
+type PackageReview struct {
+	gorm.Model
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Publisher string `json:"publisher"`
+	Reviewer  string `json:"reviewer"`
+	Approved  bool   `json:"approved"`
+	Reason    string `json:"reason"`
+}
+
+// Namespaces configured under approval.namespaces hold new versions until
+// they are approved.
+//
+func requiresApproval(name string) bool {
+	ns := strings.SplitN(name, "/", 2)[0]
+	for _, n := range viper.GetStringSlice("approval.namespaces") {
+		if strings.EqualFold(n, ns) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds a private package, which is either published right away or held for approval
+//
+func addPrivatePackage(name, version, publisher string) (*Package, error) {
+	pkg := &Package{
+		Name:      name,
+		Version:   version,
+		Private:   true,
+		Status:    StatusPublished,
+		Publisher: publisher,
+	}
+	if requiresApproval(name) {
+		pkg.Status = StatusPending
+	}
+	pkg, err := Packages.AddPackage(pkg)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Status == StatusPending {
+		log.Infof("%s@%s is pending approval", name, version)
+	} else {
+		emit(EventPublished, pkg)
+	}
+	return pkg, nil
+}
+
+// Publishers recorded from an admin token. Others, such as anonymous elm
+// publish requests & webhooks, could have been sent by any admin.
+//
+func authenticatedPublisher(publisher string) bool {
+	return publisher != "" && !strings.HasPrefix(publisher, "webhook:")
+}
+
+// Files of versions pending approval are stored but not served, as anyone
+// pinning the version could install it before it's approved.
+//
+func pendingVersion(name, version string) bool {
+	pkg, err := Packages.GetPackage(name, version)
+	return err == nil && pkg.Status == StatusPending
+}
+
+// Looks up the pending package addressed by the route
+//
+func routePendingPackage(w http.ResponseWriter, r *http.Request) *Package {
+	pkg := routePrivatePackage(w, r)
+	if pkg == nil {
+		return nil
+	}
+	if pkg.Status != StatusPending {
+		http.Error(w, "Package is not pending approval.", 400)
+		return nil
+	}
+	return pkg
+}
+
+func pendingPackages(w http.ResponseWriter, r *http.Request) {
+	pkgs, err := Packages.GetPendingPackages()
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	out := make([]EventPackage, len(pkgs))
+	for i := range pkgs {
+		out[i] = newEventPackage(&pkgs[i])
+	}
+	writeJson(w, out)
+}
+
+func packageReviews(w http.ResponseWriter, r *http.Request) {
+	reviews, err := Packages.GetPackageReviews()
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	writeJson(w, reviews)
+}
+
+func approvePackage(w http.ResponseWriter, r *http.Request) {
+	pkg := routePendingPackage(w, r)
+	if pkg == nil {
+		return
+	}
+	actor := requestActor(r)
+	if actor == "" {
+		http.Error(w, "Approvals require a named admin token.", 403)
+		return
+	}
+	if pkg.Publisher == actor {
+		http.Error(w, "Packages must be approved by someone other than their publisher.", 403)
+		return
+	}
+	review := &PackageReview{
+		Name:      pkg.Name,
+		Version:   pkg.Version,
+		Publisher: pkg.Publisher,
+		Reviewer:  actor,
+		Approved:  true,
+	}
+	if !authenticatedPublisher(pkg.Publisher) {
+		// Anyone, including an approver, may have published it, so a second
+		// approver is required
+		approvals, err := Packages.GetPackageApprovals(pkg.Name, pkg.Version, pkg.CreatedAt)
+		if err != nil {
+			log.Error(err.Error())
+			http.Error(w, "Server Error.", 500)
+			return
+		}
+		for _, a := range approvals {
+			if a.Reviewer == actor {
+				http.Error(w, "Package is awaiting approval by another admin.", 409)
+				return
+			}
+		}
+		if len(approvals) == 0 {
+			if err := Packages.AddPackageReview(review); err != nil {
+				log.Error(err.Error())
+				http.Error(w, "Server Error.", 500)
+				return
+			}
+			log.Infof("%s approved %s@%s, awaiting a second approval", actor, pkg.Name, pkg.Version)
+			audit(r, AuditApprove, packageSubject(pkg), newEventPackage(pkg), review)
+			w.WriteHeader(202)
+			return
+		}
+	}
+	approved, err := Packages.ApprovePackage(pkg, review)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	log.Infof("%s approved %s@%s", actor, pkg.Name, pkg.Version)
+	audit(r, AuditApprove, packageSubject(pkg), newEventPackage(pkg), newEventPackage(approved))
+	emit(EventPublished, approved)
+	w.WriteHeader(204)
+}
+
+func rejectPackage(w http.ResponseWriter, r *http.Request) {
+	pkg := routePendingPackage(w, r)
+	if pkg == nil {
+		return
+	}
+	reason, _ := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+	review := &PackageReview{
+		Name:      pkg.Name,
+		Version:   pkg.Version,
+		Publisher: pkg.Publisher,
+		Reviewer:  requestActor(r),
+		Approved:  false,
+		Reason:    string(reason),
+	}
+	if err := Packages.RejectPackage(pkg, review); err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	if err := removePackageFiles(pkg.Name, pkg.Version); err != nil {
+		log.Errorf("Failed removing files of %s@%s: %s", pkg.Name, pkg.Version, err)
+	}
+	log.Infof("%s rejected %s@%s", review.Reviewer, pkg.Name, pkg.Version)
+	audit(r, AuditReject, packageSubject(pkg), newEventPackage(pkg), review)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,41 @@
+package elmproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestPendingFilesNotServed(t *testing.T) {
+	openTestStore(t, "http://127.0.0.1:1")
+	viper.Set("approval.namespaces", []string{"acme"})
+	files := map[string][]byte{
+		"elm.json":         []byte("{}"),
+		packageArchiveFile: []byte("archive"),
+	}
+	if err := storePackageFiles("acme/lib", "1.0.0", files); err != nil {
+		t.Fatal(err)
+	}
+	pending, err := addPrivatePackage("acme/lib", "1.0.0", "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve := func() (int, int) {
+		file := httptest.NewRecorder()
+		Router().ServeHTTP(file, httptest.NewRequest("GET", "/packages/acme/lib/1.0.0/elm.json", nil))
+		archive := httptest.NewRecorder()
+		serveArchive(archive, httptest.NewRequest("GET", "/acme/lib/zipball/1.0.0/", nil))
+		return file.Code, archive.Code
+	}
+	if file, archive := serve(); file != 404 || archive != 404 {
+		t.Errorf("pending elm.json & archive answered %d & %d, want 404", file, archive)
+	}
+
+	if _, err := Packages.ApprovePackage(pending, &PackageReview{Name: "acme/lib", Version: "1.0.0", Reviewer: "bob", Approved: true}); err != nil {
+		t.Fatal(err)
+	}
+	if file, archive := serve(); file != 200 || archive != 200 {
+		t.Errorf("approved elm.json & archive answered %d & %d, want 200", file, archive)
+	}
+}
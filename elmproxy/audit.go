@@ -0,0 +1,302 @@
+package elmproxy
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	AuditPublish         = "package.publish"
+	AuditYank            = "package.yank"
+	AuditDelete          = "package.delete"
+	AuditApprove         = "package.approve"
+	AuditReject          = "package.reject"
+	AuditNamespaceCreate = "namespace.create"
+	AuditTokenChange     = "token.change"
+	AuditConfigReload    = "config.reload"
+	AuditScrubRepair     = "storage.repair"
+	AuditBundleImport    = "bundle.import"
+)
+
+// Append only record of a registry mutation
+//
+type AuditEntry struct {
+	ID        uint         `gorm:"primaryKey" json:"id"`
+	CreatedAt time.Time    `gorm:"index" json:"time"`
+	Action    string       `gorm:"index" json:"action"`
+	Actor     string       `gorm:"index" json:"actor"`
+	ClientIP  string       `json:"clientIp"`
+	Subject   string       `gorm:"index" json:"subject"`
+	Before    AuditDetails `json:"before,omitempty"`
+	After     AuditDetails `json:"after,omitempty"`
+}
+
+// JSON details of an audit entry, stored as text. gorm would insert a
+// json.RawMessage as a row value, as it does with other byte slice types.
+//
+type AuditDetails json.RawMessage
+
+func (d AuditDetails) Value() (driver.Value, error) {
+	if d == nil {
+		return nil, nil
+	}
+	return string(d), nil
+}
+
+func (d *AuditDetails) Scan(v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		*d = nil
+	case string:
+		*d = AuditDetails(v)
+	case []byte:
+		*d = append(AuditDetails(nil), v...)
+	default:
+		return fmt.Errorf("Unsupported audit details %T", v)
+	}
+	return nil
+}
+
+func (d AuditDetails) MarshalJSON() ([]byte, error) {
+	return json.RawMessage(d).MarshalJSON()
+}
+
+type AuditFilter struct {
+	Action  string
+	Actor   string
+	Subject string
+	Since   time.Time
+	Until   time.Time
+	AfterID uint
+	Limit   int
+}
+
+func newAuditEntry(action, actor, ip, subject string, before, after interface{}) *AuditEntry {
+	e := &AuditEntry{
+		Action:   action,
+		Actor:    actor,
+		ClientIP: ip,
+		Subject:  subject,
+	}
+	if before != nil {
+		e.Before, _ = json.Marshal(before)
+	}
+	if after != nil {
+		e.After, _ = json.Marshal(after)
+	}
+	return e
+}
+
+func recordAudit(e *AuditEntry) {
+	if err := Packages.AddAuditEntry(e); err != nil {
+		log.Errorf("Failed recording %s of %s by %s: %s", e.Action, e.Subject, e.Actor, err)
+	}
+}
+
+// Records a mutation made through an API request
+//
+func audit(r *http.Request, action, subject string, before, after interface{}) {
+	actor := requestActor(r)
+	if actor == "" {
+		actor = "anonymous"
+	}
+	recordAudit(newAuditEntry(action, actor, clientIP(r), subject, before, after))
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func packageSubject(pkg *Package) string {
+	return pkg.Name + "@" + pkg.Version
+}
+
+func auditFilter(r *http.Request) (*AuditFilter, error) {
+	q := r.URL.Query()
+	f := &AuditFilter{
+		Action:  q.Get("action"),
+		Actor:   q.Get("actor"),
+		Subject: q.Get("subject"),
+		Limit:   100,
+	}
+	var err error
+	if s := q.Get("since"); s != "" {
+		if f.Since, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, fmt.Errorf("Invalid since: %w", err)
+		}
+	}
+	if s := q.Get("until"); s != "" {
+		if f.Until, err = time.Parse(time.RFC3339, s); err != nil {
+			return nil, fmt.Errorf("Invalid until: %w", err)
+		}
+	}
+	if s := q.Get("after"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid after: %w", err)
+		}
+		f.AfterID = uint(id)
+	}
+	if s := q.Get("limit"); s != "" {
+		if f.Limit, err = strconv.Atoi(s); err != nil || f.Limit < 1 || f.Limit > 1000 {
+			return nil, fmt.Errorf("Invalid limit, must be between 1 and 1000")
+		}
+	}
+	return f, nil
+}
+
+func auditLog(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	entries, err := Packages.GetAuditEntries(f)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	writeJson(w, entries)
+}
+
+// Exports every matching entry as JSON lines, ignoring limit
+//
+func auditExport(w http.ResponseWriter, r *http.Request) {
+	f, err := auditFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	f.Limit = 1000
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for {
+		entries, err := Packages.GetAuditEntries(f)
+		if err != nil {
+			log.Error(err.Error())
+			return
+		}
+		for i := range entries {
+			if err := enc.Encode(&entries[i]); err != nil {
+				return
+			}
+		}
+		if len(entries) < f.Limit {
+			return
+		}
+		f.AfterID = entries[len(entries)-1].ID
+	}
+}
+
+// Watches the config file, recording reloads and admin token changes
+//
+func WatchConfig() {
+	var mu sync.Mutex
+	settings := redactedSettings()
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		mu.Lock()
+		defer mu.Unlock()
+		next := redactedSettings()
+		before, after := settingsDiff(settings, next)
+		settings = next
+		if len(after) == 0 && len(before) == 0 {
+			return
+		}
+		log.Info("Configuration reloaded from ", e.Name)
+		recordAudit(newAuditEntry(AuditConfigReload, "system", "", e.Name, before, after))
+		_, removed := before["credentials.admins"]
+		if _, changed := after["credentials.admins"]; changed || removed {
+			recordAudit(newAuditEntry(AuditTokenChange, "system", "", "credentials.admins", before["credentials.admins"], after["credentials.admins"]))
+		}
+	})
+	viper.WatchConfig()
+}
+
+// Flattened settings with credentials replaced by a digest, so changes to
+// them are visible without recording the values.
+//
+func redactedSettings() map[string]interface{} {
+	out := make(map[string]interface{})
+	for _, key := range viper.AllKeys() {
+		out[key] = redact(key, viper.Get(key))
+	}
+	return out
+}
+
+// Redacts sensitive values, including those nested in lists such as webhook targets
+//
+func redact(key string, v interface{}) interface{} {
+	if isSensitiveKey(key) {
+		b, _ := json.Marshal(v)
+		h := sha256.Sum256(b)
+		return "sha256:" + hex.EncodeToString(h[:8])
+	}
+	switch val := v.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = redact("", item)
+		}
+		return out
+	case map[interface{}]interface{}:
+		out := make(map[string]interface{})
+		for k, item := range val {
+			out[fmt.Sprint(k)] = redact(fmt.Sprint(k), item)
+		}
+		return out
+	case map[string]interface{}:
+		out := make(map[string]interface{})
+		for k, item := range val {
+			out[k] = redact(k, item)
+		}
+		return out
+	}
+	return v
+}
+
+func isSensitiveKey(key string) bool {
+	for _, s := range []string{"credentials", "secret", "token", "password"} {
+		if strings.Contains(strings.ToLower(key), s) {
+			return true
+		}
+	}
+	return false
+}
+
+func settingsDiff(a, b map[string]interface{}) (map[string]interface{}, map[string]interface{}) {
+	before := make(map[string]interface{})
+	after := make(map[string]interface{})
+	for k, v := range a {
+		if nv, ok := b[k]; !ok || !reflect.DeepEqual(v, nv) {
+			before[k] = v
+			if ok {
+				after[k] = nv
+			}
+		}
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			after[k] = v
+		}
+	}
+	return before, after
+}
@@ -0,0 +1,311 @@
+package elmproxy
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Describes a backup archive, stored as its first entry backup.json
+//
+// Full backups hold a snapshot of the database, the storage directory
+// without cached responses, the config and the CA. Incremental backups hold
+// the packages after Since and their stored files.
+//
+type BackupInfo struct {
+	Created     time.Time `json:"created"`
+	Incremental bool      `json:"incremental"`
+	// Packages after Since and up to Until are included
+	Since    uint64 `json:"since"`
+	Until    uint64 `json:"until"`
+	Packages int    `json:"packages"`
+}
+
+const (
+	backupInfoEntry   = "backup.json"
+	backupConfigEntry = "config.yml"
+	backupDbEntry     = "db.sqlite3"
+	backupPkgsEntry   = "packages.json"
+	backupCertEntry   = "ca/ca.crt"
+	backupKeyEntry    = "ca/ca.key"
+	backupStorage     = "storage/"
+)
+
+// Writes a gzipped tar backup, incremental when since is above zero. The
+// archive holds tokens and the CA key, and must be kept private.
+//
+func Backup(w io.Writer, since uint64) (*BackupInfo, error) {
+	pkgs, err := Packages.GetPackageRange(since)
+	if err != nil {
+		return nil, err
+	}
+	info := &BackupInfo{Created: time.Now().UTC(), Incremental: since > 0, Since: since, Until: since}
+	for _, pkg := range pkgs {
+		if uint64(pkg.ID) > info.Until {
+			info.Until = uint64(pkg.ID)
+		}
+	}
+	info.Packages = len(pkgs)
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	b, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarEntry(tw, backupInfoEntry, b); err != nil {
+		return nil, err
+	}
+	if info.Incremental {
+		err = backupPackages(tw, pkgs)
+	} else {
+		err = backupInstance(tw)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return info, gz.Close()
+}
+
+// Packages are stored before their files, which are written first when
+// publishing, so every package in the snapshot has its files.
+//
+func backupInstance(tw *tar.Writer) error {
+	if path := viper.ConfigFileUsed(); path != "" {
+		if err := writeTarFile(tw, backupConfigEntry, path); err != nil {
+			return err
+		}
+	}
+	for entry, key := range map[string]string{backupCertEntry: "ca.cert", backupKeyEntry: "ca.key"} {
+		if err := writeTarFile(tw, entry, viper.GetString(key)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "elm-package-proxy-backup")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, backupDbEntry)
+	if err := Packages.BackupTo(snapshot); err != nil {
+		return err
+	}
+	if err := writeTarFile(tw, backupDbEntry, snapshot); err != nil {
+		return err
+	}
+
+	storage := viper.GetString("services.storage.dir")
+	return filepath.Walk(storage, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(storage, path)
+		// Cached responses are fetched again
+		if fi.IsDir() && rel == "cache" {
+			return filepath.SkipDir
+		}
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".tmp-") {
+			return nil
+		}
+		return writeTarFile(tw, backupStorage+filepath.ToSlash(rel), path)
+	})
+}
+
+func backupPackages(tw *tar.Writer, pkgs []Package) error {
+	b, err := json.Marshal(pkgs)
+	if err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, backupPkgsEntry, b); err != nil {
+		return err
+	}
+	storage := viper.GetString("services.storage.dir")
+	written := make(map[string]bool)
+	for _, pkg := range pkgs {
+		m, err := readManifest(pkg.Name, pkg.Version)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		paths := []string{manifestPath(pkg.Name, pkg.Version)}
+		for _, digest := range m.Files {
+			paths = append(paths, blobPath(digest))
+		}
+		for _, path := range paths {
+			if written[path] {
+				continue
+			}
+			written[path] = true
+			rel, _ := filepath.Rel(storage, path)
+			if err := writeTarFile(tw, backupStorage+filepath.ToSlash(rel), path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, b []byte) error {
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: time.Now()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(b)
+	return err
+}
+
+func writeTarFile(tw *tar.Writer, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	hdr := &tar.Header{Name: name, Mode: 0600, Size: fi.Size(), ModTime: fi.ModTime()}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+func readBackupInfo(tr *tar.Reader) (*BackupInfo, error) {
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, err
+	}
+	if hdr.Name != backupInfoEntry {
+		return nil, errors.New("Not a backup archive")
+	}
+	info := &BackupInfo{}
+	if err := json.NewDecoder(tr).Decode(info); err != nil {
+		return nil, fmt.Errorf("Invalid %s: %w", backupInfoEntry, err)
+	}
+	return info, nil
+}
+
+// Reads the config stored in a full backup, nil when it has none
+//
+func BackupConfig(r io.Reader) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	if _, err := readBackupInfo(tr); err != nil {
+		return nil, err
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if hdr.Name == backupConfigEntry {
+			return ioutil.ReadAll(tr)
+		}
+	}
+}
+
+// Restores a backup into the configured database, storage directory and CA
+// files. Full backups require a new instance, unless force is set, while
+// incremental backups are merged into an existing one.
+//
+func Restore(r io.Reader, force bool) (*BackupInfo, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	info, err := readBackupInfo(tr)
+	if err != nil {
+		return nil, err
+	}
+	dbFile := viper.GetString("services.database.file")
+	if info.Incremental {
+		if err := Open(); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(dbFile); err == nil && !force {
+		return nil, fmt.Errorf("A database already exists at %s", dbFile)
+	}
+
+	storage := viper.GetString("services.storage.dir")
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if strings.Contains(hdr.Name, "..") || filepath.IsAbs(hdr.Name) {
+			return nil, fmt.Errorf("Invalid archive entry %s", hdr.Name)
+		}
+		switch {
+		case hdr.Name == backupConfigEntry:
+			// Handled before restoring, see BackupConfig
+		case hdr.Name == backupDbEntry:
+			err = restoreFile(tr, dbFile, 0600, true)
+		case hdr.Name == backupCertEntry:
+			err = restoreFile(tr, viper.GetString("ca.cert"), 0644, force)
+		case hdr.Name == backupKeyEntry:
+			err = restoreFile(tr, viper.GetString("ca.key"), 0600, force)
+		case hdr.Name == backupPkgsEntry:
+			var pkgs []Package
+			if err = json.NewDecoder(tr).Decode(&pkgs); err == nil {
+				var n int
+				n, err = Packages.RestorePackages(pkgs)
+				log.Infof("Restored %d of %d package(s)", n, len(pkgs))
+			}
+		case strings.HasPrefix(hdr.Name, backupStorage):
+			// Existing blobs have the same content, manifests are replaced
+			err = restoreFile(tr, filepath.Join(storage, filepath.FromSlash(strings.TrimPrefix(hdr.Name, backupStorage))), 0644, true)
+		default:
+			log.Warnf("Skipping unknown archive entry %s", hdr.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+// Writes a restored file, keeping an existing one unless overwrite is set
+//
+func restoreFile(r io.Reader, path string, mode os.FileMode, overwrite bool) error {
+	if _, err := os.Stat(path); err == nil && !overwrite {
+		log.Warnf("Keeping existing %s", path)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	err := writeFileAtomic(path, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, mode)
+}
@@ -0,0 +1,665 @@
+package elmproxy
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Upstreams & sync state types of packages imported from files, which are
+// stored like those of private packages.
+//
+const (
+	bundleUpstream  = "bundle"
+	elmHomeUpstream = "elm-home"
+)
+
+var localUpstreams = []string{bundleUpstream, elmHomeUpstream}
+
+const (
+	bundleManifestEntry = "bundle.json"
+	bundlePackagesDir   = "packages/"
+)
+
+// Files every bundled package version has
+//
+var bundleFiles = []string{"elm.json", "endpoint.json", packageArchiveFile}
+
+var bundleEntryRe = regexp.MustCompile(`^packages/([^/]+/[^/]+)/([^/]+)/([^/]+)$`)
+
+// Self-contained subset of the registry, for proxies without internet access.
+// Stored as the first entry bundle.json of a gzipped tar, followed by the
+// files of every package under packages/{author}/{name}/{version}/.
+//
+type Bundle struct {
+	Created time.Time `json:"created"`
+	// Ordered as published on the exporting proxy
+	Packages []BundlePackage `json:"packages"`
+}
+
+type BundlePackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Private bool   `json:"private"`
+	// SHA-256 of every file, by name
+	Files map[string]string `json:"files"`
+}
+
+// Result of importing a bundle
+//
+type BundleReport struct {
+	Packages int `json:"packages"`
+	// Versions added to the registry, the others were already known
+	Added []string `json:"added"`
+}
+
+// Problem with the content of a bundle, rather than the proxy importing it
+//
+type BundleError struct {
+	msg string
+}
+
+func (e *BundleError) Error() string {
+	return e.msg
+}
+
+func invalidBundle(format string, a ...interface{}) error {
+	return &BundleError{fmt.Sprintf(format, a...)}
+}
+
+// Writes a bundle of the packages an application elm.json depends on, or of
+// the given author/name@version packages along with their dependencies.
+// Packages without a version are bundled at their latest version.
+//
+func ExportBundle(w io.Writer, appElmJson []byte, names []string) (*Bundle, error) {
+	published, err := Packages.GetAllPackages()
+	if err != nil {
+		return nil, err
+	}
+	versions := make(map[string][]string)
+	for _, pkg := range published {
+		versions[pkg.Name] = append(versions[pkg.Name], pkg.Version)
+	}
+
+	selected := make(map[string]string)
+	var queue []string
+	if appElmJson != nil {
+		deps, err := applicationDependencies(appElmJson)
+		if err != nil {
+			return nil, err
+		}
+		for name, version := range deps {
+			selected[name] = version
+			queue = append(queue, name)
+		}
+	}
+	for _, n := range names {
+		name, version := n, ""
+		if i := strings.Index(n, "@"); i >= 0 {
+			name, version = n[:i], n[i+1:]
+		}
+		if version == "" {
+			if version = latestVersion(versions[name], ""); version == "" {
+				return nil, fmt.Errorf("Unknown package %s", name)
+			}
+		}
+		if v, ok := selected[name]; ok && v != version {
+			return nil, fmt.Errorf("Both %s@%s and %s@%s were requested", name, v, name, version)
+		}
+		selected[name] = version
+		queue = append(queue, name)
+	}
+
+	bundled := make(map[string]*bundledPackage)
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		if bundled[name] != nil {
+			continue
+		}
+		bp, err := collectBundlePackage(name, selected[name])
+		if err != nil {
+			return nil, fmt.Errorf("Failed bundling %s@%s: %w", name, selected[name], err)
+		}
+		bundled[name] = bp
+		// Application dependencies are complete, so only listed packages add any
+		ej := struct {
+			Dependencies map[string]string `json:"dependencies"`
+		}{}
+		if err := json.Unmarshal(bp.files["elm.json"], &ej); err != nil {
+			return nil, fmt.Errorf("Invalid elm.json of %s@%s: %w", name, selected[name], err)
+		}
+		for dep, constraint := range ej.Dependencies {
+			if v, ok := selected[dep]; ok {
+				if !satisfiesConstraint(constraint, v) {
+					return nil, fmt.Errorf("%s@%s requires %s %s, conflicting with %s", name, selected[name], dep, constraint, v)
+				}
+				continue
+			}
+			v := latestVersion(versions[dep], constraint)
+			if v == "" {
+				return nil, fmt.Errorf("No version of %s satisfies %s, required by %s@%s", dep, constraint, name, selected[name])
+			}
+			selected[dep] = v
+			queue = append(queue, dep)
+		}
+	}
+
+	pkgs := make([]*bundledPackage, 0, len(bundled))
+	for _, bp := range bundled {
+		pkgs = append(pkgs, bp)
+	}
+	sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].pkg.ID < pkgs[j].pkg.ID })
+	bundle := &Bundle{Created: time.Now().UTC(), Packages: make([]BundlePackage, len(pkgs))}
+	for i, bp := range pkgs {
+		bundle.Packages[i] = BundlePackage{
+			Name:    bp.pkg.Name,
+			Version: bp.pkg.Version,
+			Private: bp.pkg.Private,
+			Files:   make(map[string]string, len(bp.files)),
+		}
+		for file, b := range bp.files {
+			bundle.Packages[i].Files[file] = digestOf(b)
+		}
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	b, err := json.MarshalIndent(bundle, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeTarEntry(tw, bundleManifestEntry, b); err != nil {
+		return nil, err
+	}
+	for _, bp := range pkgs {
+		files := make([]string, 0, len(bp.files))
+		for file := range bp.files {
+			files = append(files, file)
+		}
+		sort.Strings(files)
+		for _, file := range files {
+			entry := fmt.Sprintf("%s%s/%s/%s", bundlePackagesDir, bp.pkg.Name, bp.pkg.Version, file)
+			if err := writeTarEntry(tw, entry, bp.files[file]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return bundle, gz.Close()
+}
+
+// Exact versions of every dependency & test dependency of an application
+//
+func applicationDependencies(b []byte) (map[string]string, error) {
+	type deps struct {
+		Direct   map[string]string `json:"direct"`
+		Indirect map[string]string `json:"indirect"`
+	}
+	ej := struct {
+		Type             string `json:"type"`
+		Dependencies     deps   `json:"dependencies"`
+		TestDependencies deps   `json:"test-dependencies"`
+	}{}
+	if err := json.Unmarshal(b, &ej); err != nil {
+		return nil, fmt.Errorf("Invalid elm.json: %w", err)
+	}
+	if ej.Type != "application" {
+		return nil, errors.New("elm.json type must be application, list the packages instead")
+	}
+	out := make(map[string]string)
+	for _, m := range []map[string]string{
+		ej.Dependencies.Direct, ej.Dependencies.Indirect,
+		ej.TestDependencies.Direct, ej.TestDependencies.Indirect,
+	} {
+		for name, version := range m {
+			out[name] = version
+		}
+	}
+	return out, nil
+}
+
+type bundledPackage struct {
+	pkg   *Package
+	files map[string][]byte
+}
+
+// Gathers the stored files of a package version, fetching those of public
+// packages from the registry, and verifies its archive against endpoint.json.
+//
+func collectBundlePackage(name, version string) (*bundledPackage, error) {
+	pkg, err := Packages.GetPackage(name, version)
+	if err != nil {
+		return nil, err
+	}
+	if pkg.Status != StatusPublished {
+		return nil, errors.New("package is pending approval")
+	}
+	bp := &bundledPackage{pkg: pkg, files: make(map[string][]byte)}
+	if m, err := readManifest(name, version); err == nil {
+		for file := range m.Files {
+			if bp.files[file], _, err = readPackageFile(name, version, file); err != nil {
+				return nil, err
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	for _, file := range []string{"elm.json", "endpoint.json"} {
+		if bp.files[file] != nil {
+			continue
+		}
+		var b []byte
+		if pkg.Private {
+			b, err = fetchOriginFile(name, version, file)
+		} else {
+			b, err = fetchRegistryFile(name, version, file)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		bp.files[file] = b
+	}
+
+	var e Endpoint
+	if err := json.Unmarshal(bp.files["endpoint.json"], &e); err != nil {
+		return nil, fmt.Errorf("Invalid endpoint.json: %w", err)
+	}
+	if bp.files[packageArchiveFile] == nil {
+		if bp.files[packageArchiveFile], err = fetchArchive(e.Url); err != nil {
+			return nil, fmt.Errorf("archive: %w", err)
+		}
+	}
+	h := sha1.Sum(bp.files[packageArchiveFile])
+	if sum := hex.EncodeToString(h[:]); sum != e.Hash {
+		return nil, fmt.Errorf("archive hashes to %s, endpoint.json expects %s", sum, e.Hash)
+	}
+	return bp, nil
+}
+
+// Fetches a public package file from the registry, returning the pinned copy
+//
+func fetchRegistryFile(name, version, file string) ([]byte, error) {
+	us, err := upstreams()
+	if err != nil {
+		return nil, err
+	}
+	b, err := fetchPinned(us, &PinnedFile{Name: name, Version: version, File: file})
+	if err != nil {
+		return nil, err
+	}
+	pinned, _, err := verifyPinned(name, version, file, b)
+	return pinned, err
+}
+
+func fetchArchive(archiveUrl string) ([]byte, error) {
+	req, err := http.NewRequest("GET", archiveUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := viper.GetString("credentials.github"); token != "" && matchesHost(req.URL.Host, []string{"github.com"}) {
+		req.Header.Set("Authorization", "token "+token)
+	}
+	return fetchUpstream(opZipball, req, 0)
+}
+
+// Reads a bundle, verifying every file against its hash, elm.json against
+// its package and archives against endpoint.json before storing anything.
+// New packages are appended to the registry in the bundle's order, files of
+// known packages are stored when missing. Imports are audited as made by
+// actor, from ip when made through the API.
+//
+func ImportBundle(r io.Reader, actor, ip string) (*BundleReport, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, invalidBundle("Invalid bundle: %s", err)
+	}
+	tr := tar.NewReader(gz)
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, invalidBundle("Invalid bundle: %s", err)
+	}
+	if hdr.Name != bundleManifestEntry {
+		return nil, invalidBundle("Not a bundle, %s must come first", bundleManifestEntry)
+	}
+	bundle := &Bundle{}
+	if err := json.NewDecoder(tr).Decode(bundle); err != nil {
+		return nil, invalidBundle("Invalid %s: %s", bundleManifestEntry, err)
+	}
+	files := make(map[string]map[string][]byte)
+	for _, bp := range bundle.Packages {
+		files[packageId(bp.Name, bp.Version)] = make(map[string][]byte)
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, invalidBundle("Invalid bundle: %s", err)
+		}
+		if hdr.Typeflag == tar.TypeDir {
+			continue
+		}
+		m := bundleEntryRe.FindStringSubmatch(hdr.Name)
+		if m == nil || strings.Contains(hdr.Name, "..") {
+			return nil, invalidBundle("Unexpected bundle entry %s", hdr.Name)
+		}
+		pkgFiles, ok := files[packageId(m[1], m[2])]
+		if !ok {
+			return nil, invalidBundle("%s is not listed in %s", hdr.Name, bundleManifestEntry)
+		}
+		if pkgFiles[m[3]], err = ioutil.ReadAll(tr); err != nil {
+			return nil, invalidBundle("Invalid bundle: %s", err)
+		}
+	}
+	for _, bp := range bundle.Packages {
+		if err := verifyBundlePackage(&bp, files[packageId(bp.Name, bp.Version)]); err != nil {
+			return nil, err
+		}
+	}
+
+	added, err := addStoredPackages(bundleUpstream, bundle.Packages, files)
+	if err != nil {
+		return nil, err
+	}
+	report := &BundleReport{Packages: len(bundle.Packages), Added: added}
+	log.Infof("Imported a bundle of %d package(s), %d new", report.Packages, len(added))
+	recordAudit(newAuditEntry(AuditBundleImport, actor, ip, bundleUpstream, nil, report))
+	return report, nil
+}
+
+// Stores the files of verified packages, keeping files already stored, and
+// appends the new ones to the registry in order, as received from upstream.
+// Returns the versions added.
+//
+func addStoredPackages(upstream string, bps []BundlePackage, files map[string]map[string][]byte) ([]string, error) {
+	var pkgs []Package
+	for _, bp := range bps {
+		existing, err := Packages.GetPackage(bp.Name, bp.Version)
+		known := err == nil
+		if err != nil && err != gorm.ErrRecordNotFound {
+			return nil, err
+		}
+		if known && existing.Private != bp.Private {
+			log.Warnf("Skipping %s@%s, its visibility differs from the imported one", bp.Name, bp.Version)
+			continue
+		}
+		if err := storeBundleFiles(bp.Name, bp.Version, files[packageId(bp.Name, bp.Version)]); err != nil {
+			return nil, err
+		}
+		if !known {
+			pkgs = append(pkgs, Package{
+				Name:     bp.Name,
+				Version:  bp.Version,
+				Private:  bp.Private,
+				Status:   StatusPublished,
+				Upstream: upstream,
+			})
+		}
+	}
+
+	state, err := Packages.GetSyncState(upstream)
+	if err == gorm.ErrRecordNotFound {
+		state, err = &SyncState{Upstream: upstream, Type: upstream}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state.LastAttempt = time.Now().UTC()
+	state.LastSuccess = state.LastAttempt
+	state.LastCount = len(bps)
+	rw.Lock()
+	added, err := Packages.ApplySync(state, pkgs)
+	if err == nil && len(added) > 0 {
+		if serr := updateSnapshot(false); serr != nil {
+			log.Error("Failed updating registry snapshot ", serr)
+		}
+	}
+	rw.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	out := make([]string, len(added))
+	for i := range added {
+		out[i] = packageSubject(&added[i])
+	}
+	if len(added) > 0 {
+		emit(EventSynced, packagePointers(added)...)
+	}
+	return out, nil
+}
+
+func packageId(name, version string) string {
+	return name + "@" + version
+}
+
+func verifyBundlePackage(bp *BundlePackage, files map[string][]byte) error {
+	subject := packageId(bp.Name, bp.Version)
+	for _, file := range bundleFiles {
+		if _, ok := bp.Files[file]; !ok {
+			return invalidBundle("%s is missing %s", subject, file)
+		}
+	}
+	for file, digest := range bp.Files {
+		b, ok := files[file]
+		if !ok {
+			return invalidBundle("%s is missing %s", subject, file)
+		}
+		if sum := digestOf(b); sum != digest {
+			return invalidBundle("%s of %s hashes to %s, the bundle lists %s", file, subject, sum, digest)
+		}
+	}
+	for file := range files {
+		if _, ok := bp.Files[file]; !ok {
+			return invalidBundle("%s of %s is not listed in %s", file, subject, bundleManifestEntry)
+		}
+	}
+	if err := checkElmJson(&Package{Name: bp.Name, Version: bp.Version}, files["elm.json"]); err != nil {
+		return invalidBundle("elm.json of %s is %s", subject, err)
+	}
+	var e Endpoint
+	if err := json.Unmarshal(files["endpoint.json"], &e); err != nil {
+		return invalidBundle("endpoint.json of %s is invalid: %s", subject, err)
+	}
+	h := sha1.Sum(files[packageArchiveFile])
+	if sum := hex.EncodeToString(h[:]); sum != e.Hash {
+		return invalidBundle("Archive of %s hashes to %s, endpoint.json expects %s", subject, sum, e.Hash)
+	}
+	// Public files must match those already pinned from the registry
+	if !bp.Private {
+		for _, file := range []string{"elm.json", "endpoint.json"} {
+			pin, err := Packages.GetPinnedFile(bp.Name, bp.Version, file)
+			if err == nil && pin.Hash != bp.Files[file] {
+				return invalidBundle("%s of %s differs from the copy pinned from the registry", file, subject)
+			}
+		}
+	}
+	return nil
+}
+
+// Stores the bundled files of a package version, keeping files already stored
+//
+func storeBundleFiles(name, version string, files map[string][]byte) error {
+	m, err := readManifest(name, version)
+	if os.IsNotExist(err) {
+		return storePackageFiles(name, version, files)
+	} else if err != nil {
+		return err
+	}
+	missing := make(map[string][]byte)
+	for file, b := range files {
+		if _, ok := m.Files[file]; !ok {
+			missing[file] = b
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return storePackageFiles(name, version, missing)
+}
+
+var zipballPathRe = regexp.MustCompile(`^/([^/]+/[^/]+)/zipball/([^/]+)/?$`)
+
+// Serves archives stored with a package version, such as those imported from
+// bundles or fetched from the origin of federated packages, at their github
+// zipball URLs. Other requests are left to the default proxy route.
+//
+func ArchiveHandler() func(r *http.Request) *http.Response {
+	return func(r *http.Request) *http.Response {
+		w := NewWriterFacade()
+		serveArchive(w, r)
+		return w.ToResponse(r)
+	}
+}
+
+func serveArchive(w http.ResponseWriter, r *http.Request) {
+	m := zipballPathRe.FindStringSubmatch(r.URL.Path)
+	if m == nil || r.Method != "GET" {
+		return
+	}
+	name, _ := url.PathUnescape(m[1])
+	version, _ := url.PathUnescape(m[2])
+	b, digest, err := readPackageFile(name, version, packageArchiveFile)
+	if err == nil && pendingVersion(name, version) {
+		http.Error(w, "Package not found.", 404)
+		return
+	}
+	if os.IsNotExist(err) {
+		// Private packages imported from other proxies are served from their origin
+		if b, err = fetchOriginFile(name, version, packageArchiveFile); err == nil {
+			digest = digestOf(b)
+		}
+	}
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Error(err.Error())
+			http.Error(w, "Server Error.", 500)
+		}
+		return
+	}
+	etag := `"` + digest + `"`
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		return
+	}
+	w.Write(b)
+}
+
+// Imports a bundle posted as the request body
+//
+func importBundle(w http.ResponseWriter, r *http.Request) {
+	report, err := ImportBundle(r.Body, requestActor(r), clientIP(r))
+	var bundleErr *BundleError
+	if errors.As(err, &bundleErr) {
+		http.Error(w, bundleErr.Error(), 400)
+		return
+	} else if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	writeJson(w, report)
+}
+
+// Elm versions are always MAJOR.MINOR.PATCH
+//
+func parseVersion(v string) ([3]int, bool) {
+	var out [3]int
+	parts := strings.Split(v, ".")
+	if len(parts) != 3 {
+		return out, false
+	}
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return out, false
+		}
+		out[i] = n
+	}
+	return out, true
+}
+
+func compareVersions(a, b [3]int) int {
+	for i := range a {
+		if a[i] != b[i] {
+			if a[i] < b[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// Whether a version satisfies an elm.json constraint such as
+// "1.0.0 <= v < 2.0.0", or any version for an empty constraint.
+//
+func satisfiesConstraint(constraint, version string) bool {
+	v, ok := parseVersion(version)
+	if !ok {
+		return false
+	}
+	if constraint == "" {
+		return true
+	}
+	parts := strings.Fields(constraint)
+	if len(parts) != 5 || parts[2] != "v" {
+		return false
+	}
+	lower, ok1 := parseVersion(parts[0])
+	upper, ok2 := parseVersion(parts[4])
+	if !ok1 || !ok2 {
+		return false
+	}
+	return compareOp(parts[1], lower, v) && compareOp(parts[3], v, upper)
+}
+
+func compareOp(op string, a, b [3]int) bool {
+	switch op {
+	case "<":
+		return compareVersions(a, b) < 0
+	case "<=":
+		return compareVersions(a, b) <= 0
+	}
+	return false
+}
+
+// Highest of the versions satisfying the constraint
+//
+func latestVersion(versions []string, constraint string) string {
+	latest := ""
+	var max [3]int
+	for _, version := range versions {
+		v, ok := parseVersion(version)
+		if !ok || !satisfiesConstraint(constraint, version) {
+			continue
+		}
+		if latest == "" || compareVersions(v, max) > 0 {
+			latest, max = version, v
+		}
+	}
+	return latest
+}
@@ -0,0 +1,202 @@
+package elmproxy
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// PEM encoded certificate of the loaded CA, served to clients
+//
+var caCertPEM []byte
+
+// Reads the CA certificate & key from ca.cert and ca.key, generating them
+// first when they are missing and ca.autoGenerate is set.
+//
+func LoadCA() (certPEM, keyPEM []byte, err error) {
+	certPath := viper.GetString("ca.cert")
+	keyPath := viper.GetString("ca.key")
+	if _, err := os.Stat(certPath); os.IsNotExist(err) && viper.GetBool("ca.autoGenerate") {
+		log.Infof("No CA found at %s, generating one.", certPath)
+		if err := GenerateCA(certPath, keyPath); err != nil {
+			return nil, nil, err
+		}
+	}
+	if certPEM, err = ioutil.ReadFile(certPath); err != nil {
+		return nil, nil, err
+	}
+	if keyPEM, err = ioutil.ReadFile(keyPath); err != nil {
+		return nil, nil, err
+	}
+	caCertPEM = certPEM
+	return certPEM, keyPEM, nil
+}
+
+// Generates a CA using ca.keyType, ca.validityDays & ca.commonName, writing
+// the certificate & key as PEM.
+//
+func GenerateCA(certPath, keyPath string) error {
+	key, err := generateKey(viper.GetString("ca.keyType"))
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName:   viper.GetString("ca.commonName"),
+			Organization: []string{"elm-package-proxy"},
+		},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.AddDate(0, 0, viper.GetInt("ca.validityDays")),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	for _, p := range []string{certPath, keyPath} {
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+}
+
+// Issues a server certificate for hosts signed by the CA, used when serving
+// registry hosts directly over TLS.
+//
+func LeafCertificate(ca *tls.Certificate, hosts []string) (*tls.Certificate, error) {
+	caLeaf := ca.Leaf
+	if caLeaf == nil {
+		var err error
+		if caLeaf, err = x509.ParseCertificate(ca.Certificate[0]); err != nil {
+			return nil, err
+		}
+	}
+	caKey, ok := ca.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key cannot be used for signing")
+	}
+	key, err := generateKey("ecdsa")
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hosts[0]},
+		DNSNames:     hosts,
+		NotBefore:    now.Add(-time.Hour),
+		// Clients reject server certificates valid for longer than 398 days
+		NotAfter:    now.AddDate(0, 0, 397),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, caLeaf, key.Public(), caKey)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, caLeaf.Raw},
+		PrivateKey:  key,
+	}, nil
+}
+
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "ecdsa":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case "rsa4096":
+		return rsa.GenerateKey(rand.Reader, 4096)
+	}
+	return nil, fmt.Errorf("Unsupported key type %s, expected ecdsa, rsa or rsa4096", keyType)
+}
+
+func caPem(w http.ResponseWriter, r *http.Request) {
+	if caCertPEM == nil {
+		http.Error(w, "No CA loaded.", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="elm-package-proxy.crt"`)
+	w.Write(caCertPEM)
+}
+
+func caDer(w http.ResponseWriter, r *http.Request) {
+	block, _ := pem.Decode(caCertPEM)
+	if block == nil {
+		http.Error(w, "No CA loaded.", 404)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+	w.Header().Set("Content-Disposition", `attachment; filename="elm-package-proxy.der"`)
+	w.Write(block.Bytes)
+}
+
+// Shell snippets trusting the CA, for the platform given by ?platform=
+//
+func caSetup(w http.ResponseWriter, r *http.Request) {
+	base := fmt.Sprintf("http://%s", r.Host)
+	download := fmt.Sprintf("curl -fsSL -o elm-package-proxy.crt %s/ca.crt\n", base)
+	var snippet string
+	switch r.URL.Query().Get("platform") {
+	case "linux", "":
+		snippet = download + `
+# Debian & Ubuntu
+sudo cp elm-package-proxy.crt /usr/local/share/ca-certificates/elm-package-proxy.crt
+sudo update-ca-certificates
+
+# Fedora, RHEL & CentOS
+sudo cp elm-package-proxy.crt /etc/pki/ca-trust/source/anchors/elm-package-proxy.crt
+sudo update-ca-trust
+`
+	case "macos":
+		snippet = download + `sudo security add-trusted-cert -d -r trustRoot -k /Library/Keychains/System.keychain elm-package-proxy.crt
+`
+	case "node":
+		snippet = download + `export NODE_EXTRA_CA_CERTS="$PWD/elm-package-proxy.crt"
+`
+	default:
+		http.Error(w, "Unknown platform, expected linux, macos or node", 400)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, snippet)
+}
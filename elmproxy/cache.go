@@ -0,0 +1,204 @@
+package elmproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Marks responses served from the cache because the upstream failed
+//
+const staleWarning = `111 - "Revalidation Failed"`
+
+// Stored with cached responses, identifying their package for the GC
+//
+const cacheUrlHeader = "X-Elm-Proxy-Url"
+
+// Transport caching successful package.elm-lang.org responses, which are
+// served instead when the upstream fails, responds with a server error or
+// takes longer than proxy.cache.timeout seconds to respond. Public package
+// files are pinned, see verifyPinned.
+//
+type staleCache struct {
+	next http.RoundTripper
+}
+
+func StaleCache(next http.RoundTripper) http.RoundTripper {
+	return &staleCache{next: &pinningTransport{next: next}}
+}
+
+func (c *staleCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !viper.GetBool("proxy.cache.enabled") || req.Method != "GET" || req.Header.Get("Range") != "" ||
+		!matchesHost(req.URL.Host, []string{"package.elm-lang.org"}) {
+		return c.next.RoundTrip(req)
+	}
+	file := cacheFile(req)
+	resp, err := c.roundTrip(req)
+	if err == nil && resp.StatusCode < 500 {
+		if resp.StatusCode == 200 {
+			cacheAccess.touch(file)
+			header := resp.Header.Clone()
+			header.Set(cacheUrlHeader, req.URL.String())
+			resp.Body = &cachingBody{ReadCloser: resp.Body, file: file, header: header}
+		}
+		return resp, nil
+	}
+	stale, serr := readCachedResponse(req, file)
+	if serr != nil {
+		if !os.IsNotExist(serr) {
+			log.Error("Failed reading cached response ", serr)
+		}
+		return resp, err
+	}
+	cacheAccess.touch(file)
+	if err == nil {
+		log.Warnf("%s responded with %s, serving cached copy", req.URL, resp.Status)
+		resp.Body.Close()
+	} else {
+		log.Warnf("%s failed, serving cached copy: %s", req.URL, err)
+	}
+	return stale, nil
+}
+
+// Gives up on responses not started within proxy.cache.timeout seconds, the
+// body may still take longer.
+//
+func (c *staleCache) roundTrip(req *http.Request) (*http.Response, error) {
+	timeout := viper.GetInt64("proxy.cache.timeout")
+	if timeout <= 0 {
+		return c.next.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(time.Second*time.Duration(timeout), cancel)
+	resp, err := c.next.RoundTrip(req.WithContext(ctx))
+	timer.Stop()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// Cached responses are keyed by URL, and whether they may be gzip encoded
+//
+func cacheFile(req *http.Request) string {
+	key := req.URL.Host + req.URL.RequestURI()
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		key += "|gzip"
+	}
+	h := sha256.Sum256([]byte(key))
+	return filepath.Join(viper.GetString("services.storage.dir"), "cache", hex.EncodeToString(h[:]))
+}
+
+func readCachedResponse(req *http.Request, file string) (*http.Response, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	resp, err := http.ReadResponse(bufio.NewReader(f), req)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(b))
+	resp.Header.Del(cacheUrlHeader)
+	resp.Header.Set("Warning", staleWarning)
+	// Modification times track the last access, see accessTracker
+	if date, err := http.ParseTime(resp.Header.Get("Date")); err == nil {
+		resp.Header.Set("Age", strconv.FormatInt(int64(time.Since(date).Seconds()), 10))
+	}
+	return resp, nil
+}
+
+// Copies a response body as it's relayed, storing it in the background once
+// fully read. Bodies larger than proxy.cache.maxSize bytes are not stored.
+//
+type cachingBody struct {
+	io.ReadCloser
+	file   string
+	header http.Header
+	buf    bytes.Buffer
+	full   bool
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.full {
+		b.buf.Write(p[:n])
+		if max := viper.GetInt("proxy.cache.maxSize"); max > 0 && b.buf.Len() > max {
+			b.full = true
+			b.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && !b.full {
+		b.full = true
+		go storeCachedResponse(b.file, b.header, b.buf.Bytes())
+	}
+	return n, err
+}
+
+func storeCachedResponse(file string, header http.Header, body []byte) {
+	header.Del("Transfer-Encoding")
+	header.Del("Connection")
+	resp := &http.Response{
+		StatusCode:    200,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
+	}
+	err := os.MkdirAll(filepath.Dir(file), 0777)
+	if err == nil {
+		err = writeFileAtomic(file, func(w io.Writer) error { return resp.Write(w) })
+	}
+	if err != nil {
+		log.Error("Failed caching response ", err)
+	}
+}
+
+// Writes through a temporary file, so readers never see partial files
+//
+func writeFileAtomic(file string, write func(w io.Writer) error) error {
+	f, err := ioutil.TempFile(filepath.Dir(file), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
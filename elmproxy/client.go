@@ -0,0 +1,184 @@
+package elmproxy
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Kinds of upstream requests, each with its own timeout & retries configured
+// under outbound.operations
+//
+type operation string
+
+const (
+	opSync    operation = "sync"
+	opMirror  operation = "mirror"
+	opZipball operation = "zipball"
+)
+
+// Returned without contacting a host after it failed too many times in a row
+//
+var ErrCircuitOpen = errors.New("circuit open")
+
+// Unexpected response status from an upstream
+//
+type StatusError struct {
+	Url    string
+	Status string
+	Code   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s responded with %s", e.Url, e.Status)
+}
+
+// Server errors & rate limiting may succeed when retried, other responses won't
+//
+func (e *StatusError) Temporary() bool {
+	return e.Code >= 500 || e.Code == 429 || e.Code == 408
+}
+
+type operationPolicy struct {
+	timeout    time.Duration
+	retries    int
+	retryDelay time.Duration
+}
+
+func policyFor(op operation) operationPolicy {
+	key := "outbound.operations." + string(op)
+	p := operationPolicy{
+		timeout:    time.Second * time.Duration(viper.GetInt64(key+".timeout")),
+		retries:    viper.GetInt("outbound.retries"),
+		retryDelay: time.Millisecond * time.Duration(viper.GetInt64("outbound.retryDelay")),
+	}
+	if viper.IsSet(key + ".retries") {
+		p.retries = viper.GetInt(key + ".retries")
+	}
+	if p.timeout <= 0 {
+		p.timeout = time.Second * 20
+	}
+	return p
+}
+
+// Sends a GET request upstream, returning the body of a 2xx response. Failed
+// attempts are retried with exponential backoff, up to the operation's retries,
+// unless the failure is permanent or the host's circuit opened. A timeout
+// above zero overrides the operation's.
+//
+func fetchUpstream(op operation, req *http.Request, timeout time.Duration) ([]byte, error) {
+	p := policyFor(op)
+	if timeout > 0 {
+		p.timeout = timeout
+	}
+	for attempt := 0; ; attempt++ {
+		b, retry, err := fetchOnce(req, p.timeout)
+		if err == nil || !retry || attempt >= p.retries {
+			return b, err
+		}
+		d := retryBackoff(p.retryDelay, attempt)
+		log.Debugf("Retrying %s %s in %s: %s", op, req.URL, d, err)
+		time.Sleep(d)
+	}
+}
+
+// Single attempt, returning whether a failure may be retried
+//
+func fetchOnce(req *http.Request, timeout time.Duration) ([]byte, bool, error) {
+	host := req.URL.Host
+	if !breakers.allow(host) {
+		return nil, false, fmt.Errorf("%s: %w", host, ErrCircuitOpen)
+	}
+	c := *httpClient
+	c.Timeout = timeout
+	resp, err := c.Do(req)
+	if err != nil {
+		breakers.record(host, true)
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		serr := &StatusError{Url: req.URL.String(), Status: resp.Status, Code: resp.StatusCode}
+		breakers.record(host, serr.Temporary())
+		return nil, serr.Temporary(), serr
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	breakers.record(host, err != nil)
+	return b, err != nil, err
+}
+
+// Doubles the delay for every attempt, spread between half and the full delay
+//
+func retryBackoff(delay time.Duration, attempt int) time.Duration {
+	for i := 0; i < attempt && delay < time.Minute; i++ {
+		delay *= 2
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Per host circuit breakers. After outbound.breaker.failures consecutive
+// failures a host is skipped for outbound.breaker.cooldown seconds, after
+// which a single request is let through to probe it.
+//
+type circuitBreakers struct {
+	mu    sync.Mutex
+	hosts map[string]*circuit
+}
+
+type circuit struct {
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+var breakers = &circuitBreakers{hosts: make(map[string]*circuit)}
+
+func (b *circuitBreakers) allow(host string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.hosts[host]
+	if !ok || c.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+func (b *circuitBreakers) record(host string, failed bool) {
+	threshold := viper.GetInt("outbound.breaker.failures")
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.hosts[host]
+	if !failed {
+		if ok && !c.openUntil.IsZero() {
+			log.Infof("Circuit for %s closed", host)
+		}
+		delete(b.hosts, host)
+		return
+	}
+	if threshold <= 0 {
+		return
+	}
+	if !ok {
+		c = &circuit{}
+		b.hosts[host] = c
+	}
+	c.failures += 1
+	c.probing = false
+	if c.failures >= threshold {
+		if c.openUntil.IsZero() {
+			log.Warnf("Circuit for %s opened after %d failures", host, c.failures)
+		}
+		c.openUntil = time.Now().Add(time.Second * time.Duration(viper.GetInt64("outbound.breaker.cooldown")))
+	}
+}
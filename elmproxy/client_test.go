@@ -0,0 +1,201 @@
+package elmproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+func setClientConfig(retries, failures int) {
+	log.SetLevel(log.WarnLevel)
+	viper.Reset()
+	viper.Set("outbound.retries", retries)
+	viper.Set("outbound.retryDelay", 1)
+	viper.Set("outbound.breaker.failures", failures)
+	viper.Set("outbound.breaker.cooldown", 30)
+	breakers = &circuitBreakers{hosts: make(map[string]*circuit)}
+}
+
+// Upstream responding with code, counting the requests received
+//
+func statusServer(code int, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		w.WriteHeader(code)
+	}))
+}
+
+func fetchPath(t *testing.T, rawurl string) ([]byte, error) {
+	t.Helper()
+	req, err := http.NewRequest("GET", rawurl, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fetchUpstream(opSync, req, time.Second)
+}
+
+func TestFetchUpstreamRetries(t *testing.T) {
+	for _, tc := range []struct {
+		code     int
+		requests int32
+	}{
+		{500, 3},
+		{503, 3},
+		{429, 3},
+		{408, 3},
+		{400, 1},
+		{403, 1},
+		{404, 1},
+	} {
+		setClientConfig(2, 0)
+		var requests int32
+		srv := statusServer(tc.code, &requests)
+		_, err := fetchPath(t, srv.URL)
+		srv.Close()
+		var serr *StatusError
+		if !errors.As(err, &serr) || serr.Code != tc.code {
+			t.Errorf("%d: got error %v, want a StatusError", tc.code, err)
+		}
+		if requests != tc.requests {
+			t.Errorf("%d: sent %d request(s), want %d", tc.code, requests, tc.requests)
+		}
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	delay := 500 * time.Millisecond
+	for attempt := 0; attempt < 6; attempt++ {
+		max := delay << uint(attempt)
+		for i := 0; i < 100; i++ {
+			if d := retryBackoff(delay, attempt); d < max/2 || d > max {
+				t.Fatalf("attempt %d: backoff %s outside [%s, %s]", attempt, d, max/2, max)
+			}
+		}
+	}
+	// Doubling stops once the delay reaches a minute
+	for i := 0; i < 100; i++ {
+		if d := retryBackoff(delay, 100); d > 2*time.Minute || d <= 0 {
+			t.Fatalf("attempt 100: backoff %s is unbounded", d)
+		}
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	setClientConfig(0, 3)
+	var requests int32
+	probe := make(chan struct{})
+	release := make(chan struct{})
+	failing := int32(1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if atomic.LoadInt32(&failing) == 1 {
+			w.WriteHeader(500)
+			return
+		}
+		close(probe)
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	host := mustHost(t, srv.URL)
+
+	for i := 0; i < 3; i++ {
+		if _, err := fetchPath(t, srv.URL); errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("Circuit opened after %d failure(s)", i)
+		}
+	}
+	if _, err := fetchPath(t, srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("got %v after 3 failures, want ErrCircuitOpen", err)
+	}
+	if requests != 3 {
+		t.Fatalf("sent %d requests while open, want 3", requests)
+	}
+
+	// Cooldown elapsed
+	breakers.mu.Lock()
+	breakers.hosts[host].openUntil = time.Now().Add(-time.Second)
+	breakers.mu.Unlock()
+	atomic.StoreInt32(&failing, 0)
+	probed := make(chan error, 1)
+	go func() {
+		_, err := fetchPath(t, srv.URL)
+		probed <- err
+	}()
+	<-probe
+	if _, err := fetchPath(t, srv.URL); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("got %v during the probe, want ErrCircuitOpen", err)
+	}
+	close(release)
+	if err := <-probed; err != nil {
+		t.Fatalf("probe failed: %s", err)
+	}
+	if requests != 4 {
+		t.Errorf("sent %d requests, want a single probe", requests)
+	}
+	breakers.mu.Lock()
+	_, open := breakers.hosts[host]
+	breakers.mu.Unlock()
+	if open {
+		t.Error("Circuit still open after a successful probe")
+	}
+}
+
+func mustHost(t *testing.T, rawurl string) string {
+	t.Helper()
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u.Host
+}
+
+type trackedBody struct {
+	io.ReadCloser
+	closed *int32
+}
+
+func (b trackedBody) Close() error {
+	atomic.AddInt32(b.closed, 1)
+	return b.ReadCloser.Close()
+}
+
+type trackingTransport struct {
+	responses, closed int32
+}
+
+func (t *trackingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	atomic.AddInt32(&t.responses, 1)
+	resp.Body = trackedBody{resp.Body, &t.closed}
+	return resp, nil
+}
+
+func TestFetchUpstreamClosesBodies(t *testing.T) {
+	setClientConfig(2, 0)
+	tr := &trackingTransport{}
+	defer func(c *http.Client) { httpClient = c }(httpClient)
+	httpClient = &http.Client{Transport: tr}
+	for _, code := range []int{200, 404, 500} {
+		var requests int32
+		srv := statusServer(code, &requests)
+		fetchPath(t, srv.URL)
+		srv.Close()
+	}
+	if tr.responses != 5 {
+		t.Errorf("got %d responses, want 5", tr.responses)
+	}
+	if tr.closed != tr.responses {
+		t.Errorf("closed %d of %d response bodies", tr.closed, tr.responses)
+	}
+}
@@ -2,6 +2,7 @@ package elmproxy
 
 import (
 	"bytes"
+	"expvar"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,8 +10,8 @@ import (
 	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
+	"strings"
 
 	"encoding/json"
 
@@ -44,9 +45,34 @@ func Router() http.Handler {
 	mux.HandleFunc("/all-packages/since/{pkgNumber:[0-9]+}", packagesSince)
 	mux.HandleFunc("/all-packages", allPackages)
 	mux.HandleFunc("/register", registerPackage)
+	mux.HandleFunc("/events", streamEvents).Methods("GET")
+	mux.HandleFunc("/health", health).Methods("GET")
+	mux.HandleFunc("/federation/packages/since/{id:[0-9]+}", tokenOnly("credentials.federation", federatedPackages)).Methods("GET")
+	mux.HandleFunc("/ca.crt", caPem).Methods("GET")
+	mux.HandleFunc("/ca.der", caDer).Methods("GET")
+	mux.HandleFunc("/ca/setup", caSetup).Methods("GET")
 	mux.HandleFunc("/packages/{group}/{name}/{version}/elm.json", elmJson)
 	mux.HandleFunc("/packages/{group}/{name}/{version}/endpoint.json", endpoint)
+	mux.HandleFunc("/packages/{group}/{name}/{version}/package.zip", tokenOnly("credentials.federation", packageArchive)).Methods("GET")
 	mux.HandleFunc("/private-package", privatePackageSubmit)
+	mux.HandleFunc("/hooks/{provider:github|gitea|gitlab}", receiveHook).Methods("POST")
+	mux.HandleFunc("/admin/sync", adminOnly(getSyncStatus)).Methods("GET")
+	mux.HandleFunc("/admin/sync", adminOnly(triggerSync)).Methods("POST")
+	mux.HandleFunc("/admin/metrics", adminOnly(expvar.Handler().ServeHTTP)).Methods("GET")
+	mux.HandleFunc("/admin/integrity/tampered", adminOnly(tamperedFiles)).Methods("GET")
+	mux.HandleFunc("/admin/integrity/scrub", adminOnly(getScrubReport)).Methods("GET")
+	mux.HandleFunc("/admin/integrity/scrub", adminOnly(triggerScrub)).Methods("POST")
+	mux.HandleFunc("/admin/bundles", adminOnly(importBundle)).Methods("POST")
+	mux.HandleFunc("/admin/audit", adminOnly(auditLog)).Methods("GET")
+	mux.HandleFunc("/admin/audit/export", adminOnly(auditExport)).Methods("GET")
+	mux.HandleFunc("/admin/namespaces", adminOnly(namespaces)).Methods("GET")
+	mux.HandleFunc("/admin/namespaces", adminOnly(createNamespace)).Methods("POST")
+	mux.HandleFunc("/admin/packages/pending", adminOnly(pendingPackages)).Methods("GET")
+	mux.HandleFunc("/admin/packages/reviews", adminOnly(packageReviews)).Methods("GET")
+	mux.HandleFunc("/admin/packages/{group}/{name}/{version}/yank", adminOnly(yankPackage)).Methods("POST")
+	mux.HandleFunc("/admin/packages/{group}/{name}/{version}/approve", adminOnly(approvePackage)).Methods("POST")
+	mux.HandleFunc("/admin/packages/{group}/{name}/{version}/reject", adminOnly(rejectPackage)).Methods("POST")
+	mux.HandleFunc("/admin/packages/{group}/{name}/{version}", adminOnly(deletePackage)).Methods("DELETE")
 	return mux
 }
 
@@ -104,7 +130,7 @@ func registerPackage(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Invalid multipart payload", 400)
 		return
 	}
-	path := filepath.Join(viper.GetString("services.storage.dir"), "packages", name, version)
+	files := make(map[string][]byte)
 
 	for err != io.EOF {
 		switch p.FormName() {
@@ -120,113 +146,145 @@ func registerPackage(w http.ResponseWriter, r *http.Request) {
 				http.Error(w, "Invalid elm.json", 400)
 				return
 			}
-			if err := os.MkdirAll(path, 0777); err != nil {
+			var b bytes.Buffer
+			enc := json.NewEncoder(&b)
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(m); err != nil {
+				log.Error(err.Error())
 				http.Error(w, "Server Error.", 500)
 				return
 			}
-			f, err := os.OpenFile(filepath.Join(path, "elm.json"), os.O_CREATE|os.O_WRONLY, 0777)
+			files["elm.json"] = b.Bytes()
+		case "docs.json", "README.md":
+			b, err := ioutil.ReadAll(p)
 			if err != nil {
-				log.Error(err.Error())
+				http.Error(w, "Invalid multipart payload", 400)
 				return
 			}
-			defer f.Close()
-			enc := json.NewEncoder(f)
-			enc.SetEscapeHTML(false)
-			if err := enc.Encode(m); err != nil {
-				log.Error(err.Error())
-			}
-		case "docs.json":
-			b, _ := ioutil.ReadAll(p)
-			ioutil.WriteFile(filepath.Join(path, "docs.json"), b, 0777)
-		case "README.md":
-			b, _ := ioutil.ReadAll(p)
-			ioutil.WriteFile(filepath.Join(path, "README.md"), b, 0777)
+			files[p.FormName()] = b
 		case "github-hash":
-			b, _ := ioutil.ReadAll(p)
-			endpoint := Endpoint{
+			b, err := ioutil.ReadAll(p)
+			if err != nil {
+				http.Error(w, "Invalid multipart payload", 400)
+				return
+			}
+			files["endpoint.json"], _ = json.Marshal(Endpoint{
 				Url:  getZipballUrl(name, version),
 				Hash: string(b),
-			}
-			b, _ = json.Marshal(endpoint)
-			ioutil.WriteFile(filepath.Join(path, "endpoint.json"), b, 0777)
+			})
 		}
 		p, err = mr.NextPart()
 	}
-	if _, err := Packages.AddPackage(name, version, true); err != nil {
+	// elm publish can't send credentials, an admin token is optional and
+	// records who published
+	publisher, _, err := tokenActor("credentials.admins", r)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	r = withActor(r, publisher)
+
+	// Stored files and the database must not diverge
+	if err := storePackageFiles(name, version, files); err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	pkg, err := addPrivatePackage(name, version, publisher)
+	if err != nil {
 		http.Error(w, "", 500)
+		return
 	}
+	audit(r, AuditPublish, packageSubject(pkg), nil, newEventPackage(pkg))
 
 	w.Write([]byte(""))
 	w.WriteHeader(201)
 }
 
 func allPackages(w http.ResponseWriter, r *http.Request) {
-	rw.RLock()
-	defer rw.RUnlock()
-	p, err := Packages.GetAllPackages()
+	snap, err := currentSnapshot()
 	if err != nil {
-		log.Fatal(err)
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
 	}
-	m := make(map[string][]string)
-	for _, pkg := range p {
-		if versions, ok := m[pkg.Name]; ok {
-			m[pkg.Name] = append(versions, pkg.Version)
-		} else {
-			m[pkg.Name] = []string{pkg.Version}
-		}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", snap.etag)
+	w.Header().Set("Vary", "Accept-Encoding")
+	if r.Header.Get("If-None-Match") == snap.etag {
+		w.WriteHeader(304)
+		return
 	}
-	b, err := json.Marshal(m)
-	if err != nil {
-		log.Fatal(err)
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(snap.gzipped)
+		return
 	}
-	w.Write(b)
-	w.WriteHeader(200)
+	w.Write(snap.identity)
 }
 
 func packagesSince(w http.ResponseWriter, r *http.Request) {
-	rw.RLock()
-	defer rw.RUnlock()
-	since, _ := strconv.ParseInt(mux.Vars(r)["pkgNumber"], 10, 64)
-	p, err := Packages.GetPackagesSince(uint64(since))
+	snap, err := currentSnapshot()
 	if err != nil {
-		log.Fatal(err)
-	}
-	out := make([]string, len(p))
-	for i, pkg := range p {
-		out[i] = fmt.Sprintf("%s@%s", pkg.Name, pkg.Version)
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
 	}
-	b, _ := json.Marshal(out)
-	w.Write(b)
-	w.WriteHeader(200)
+	since, _ := strconv.ParseUint(mux.Vars(r)["pkgNumber"], 10, 64)
+	writeJson(w, snap.since(since))
 }
 
 func elmJson(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	path := filepath.Join(viper.GetString("services.storage.dir"), "packages", vars["group"], vars["name"], vars["version"], "elm.json")
-	if _, err := os.Stat(path); err != nil {
+	servePackageFile(w, r, "elm.json")
+}
+
+func endpoint(w http.ResponseWriter, r *http.Request) {
+	servePackageFile(w, r, "endpoint.json")
+}
+
+// Stored archive of a package version, for proxies importing it. Versions
+// without one are not found, rather than left to the default proxy route.
+//
+func packageArchive(w http.ResponseWriter, r *http.Request) {
+	f := NewWriterFacade()
+	servePackageFile(f, r, packageArchiveFile)
+	if !f.edited {
+		http.Error(w, "Package archive not found.", 404)
 		return
 	}
-	b, err := ioutil.ReadFile(path)
-	if err != nil {
-		if os.IsNotExist(err) {
-			w.WriteHeader(404)
-			return
-		}
-	}
-	w.Write(b)
+	f.CopyTo(w)
 }
 
-func endpoint(w http.ResponseWriter, r *http.Request) {
+// Serves a stored package file, fetching packages imported from another
+// proxy from their origin. Missing files are left to the default proxy route.
+//
+func servePackageFile(w http.ResponseWriter, r *http.Request, file string) {
 	vars := mux.Vars(r)
-	path := filepath.Join(viper.GetString("services.storage.dir"), "packages", vars["group"], vars["name"], vars["version"], "endpoint.json")
-
-	hashFile := filepath.Join(path)
-	b, err := ioutil.ReadFile(hashFile)
+	name := vars["group"] + "/" + vars["name"]
+	b, digest, err := readPackageFile(name, vars["version"], file)
+	if err == nil && pendingVersion(name, vars["version"]) {
+		http.Error(w, "Package not found.", 404)
+		return
+	}
+	if os.IsNotExist(err) {
+		if b, err = fetchOriginFile(name, vars["version"], file); err == nil {
+			digest = digestOf(b)
+		}
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			w.WriteHeader(404)
-			return
+		if !os.IsNotExist(err) {
+			log.Error(err.Error())
+			http.Error(w, "Server Error.", 500)
 		}
+		return
+	}
+	// Stored files never change, so their digests are strong validators
+	etag := `"` + digest + `"`
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(304)
+		return
 	}
 	w.Write(b)
 }
@@ -277,23 +335,35 @@ func (w *ResponseWriterFacade) ToResponse(r *http.Request) *http.Response {
 	if h == "" {
 		h = "application/text"
 	}
-	return goproxy.NewResponse(r, h, w.statusCode, string(w.bytes))
+	resp := goproxy.NewResponse(r, h, w.statusCode, string(w.bytes))
+	for k, v := range w.headers {
+		if k != "Content-Type" {
+			resp.Header[k] = v
+		}
+	}
+	return resp
+}
+
+func (f *ResponseWriterFacade) CopyTo(w http.ResponseWriter) {
+	for k, v := range f.headers {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(f.statusCode)
+	w.Write(f.bytes)
 }
 
 func getZipballUrl(name, version string) string {
 	return fmt.Sprintf("https://github.com/%s/zipball/%s/", name, version)
 }
 
-func fetchExternalZipball(name, version string) (io.ReadCloser, error) {
-	url := fmt.Sprintf("https://github.com/%s/zipball/%s/", name, version)
-	req, _ := http.NewRequest("GET", url, nil)
+func fetchExternalZipball(name, version string) ([]byte, error) {
+	req, err := http.NewRequest("GET", getZipballUrl(name, version), nil)
+	if err != nil {
+		return nil, err
+	}
 	token := viper.GetString("credentials.github")
 	if token != "" {
 		req.Header.Add("Authorization", "token "+token)
 	}
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	return resp.Body, nil
+	return fetchUpstream(opZipball, req, 0)
 }
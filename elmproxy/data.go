@@ -4,106 +4,415 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"math/rand"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"gorm.io/gorm"
 )
 
-// Continually synchronizes data with package.elm-lang.org
+// Continually synchronizes data with the upstream registries
 //
 var (
 	httpClient *http.Client = &http.Client{
 		Timeout: time.Second * 20,
 	}
 	lastSync int64 = 0
+	// Serializes syncs, which fetch without holding rw and only take it to
+	// store what they received
+	syncMu sync.Mutex
 )
 
+// Syncs every interval, retrying failed syncs sooner with exponential backoff
+//
 func SyncWorker(ctx context.Context) {
-	ticker := time.NewTicker(time.Second * time.Duration(viper.GetInt64("services.sync.interval")))
+	interval := time.Second * time.Duration(viper.GetInt64("services.sync.interval"))
+	timer := time.NewTimer(nextSyncDelay(interval))
+	defer timer.Stop()
+	var reconcile <-chan time.Time
+	if interval := viper.GetInt64("services.sync.reconcileInterval"); interval > 0 {
+		t := time.NewTicker(time.Second * time.Duration(interval))
+		defer t.Stop()
+		reconcile = t.C
+	}
 	for ctx.Err() == nil {
 		select {
 		case <-ctx.Done():
 			return
-		case <-ticker.C:
+		case <-reconcile:
+			if _, err := Reconcile(); err != nil {
+				log.Error(err)
+			}
+		case <-timer.C:
 			// Will skip if recently forced to sync
 			log.Debug("SyncWorker tick, fetching packages.")
-			err := fetchPackages()
-			if err != nil {
+			if err := fetchPackages(); err != nil {
 				log.Error(err)
-				continue
 			}
+			timer.Reset(nextSyncDelay(interval))
 		}
 	}
 	log.Debug("SyncWorker is done.")
 }
 
+// Delay until the next sync, the interval when healthy, otherwise an
+// exponential backoff from services.sync.retryDelay with jitter, capped at
+// the interval.
+//
+func nextSyncDelay(interval time.Duration) time.Duration {
+	d := interval
+	if failures := status.consecutiveFailures(); failures > 0 {
+		d = time.Second * time.Duration(viper.GetInt64("services.sync.retryDelay"))
+		for i := 1; i < failures && d < interval; i++ {
+			d *= 2
+		}
+		if d > interval {
+			d = interval
+		}
+		// Spread retries between half and the full delay
+		d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+	}
+	status.scheduled(time.Now().Add(d))
+	return d
+}
+
+// Registry packages are synchronized from, configured under upstreams.
+// Registry upstreams mirror the same sequence and are tried in order, failing
+// over to the next on errors. Proxy upstreams are other elm-package-proxy
+// instances, whose private packages are imported as well.
+//
+type Upstream struct {
+	Name    string `mapstructure:"name"`
+	Url     string `mapstructure:"url"`
+	Timeout int    `mapstructure:"timeout"`
+	// registry (default) or proxy
+	Type string `mapstructure:"type"`
+	// Sent as a bearer token, required by proxy upstreams
+	Token string `mapstructure:"token"`
+}
+
+// Fetches a path of the upstream, its timeout overriding the operation's
+//
+func (u *Upstream) fetch(op operation, path string) ([]byte, error) {
+	url := strings.TrimSuffix(u.Url, "/") + path
+	log.Debug("Fetching with url: ", url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if u.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+u.Token)
+	}
+	return fetchUpstream(op, req, time.Second*time.Duration(u.Timeout))
+}
+
+func (u *Upstream) get(path string, v interface{}) error {
+	b, err := u.fetch(opSync, path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func upstreams() ([]Upstream, error) {
+	var us []Upstream
+	if err := viper.UnmarshalKey("upstreams", &us); err != nil {
+		return nil, fmt.Errorf("Invalid upstreams: %w", err)
+	}
+	if len(us) == 0 {
+		us = []Upstream{{Name: "package.elm-lang.org", Url: "https://package.elm-lang.org"}}
+	}
+	for i := range us {
+		if us[i].Name == "" {
+			us[i].Name = us[i].Url
+		}
+	}
+	return us, nil
+}
+
+// Synchronization state of an upstream, updated along with the packages received
+//
+type SyncState struct {
+	Upstream string `gorm:"primaryKey" json:"upstream"`
+	Type     string `json:"type"`
+	// Registry upstreams count the versions received, proxy upstreams track
+	// the highest package id received.
+	Cursor      uint64    `json:"cursor"`
+	LastAttempt time.Time `json:"lastAttempt"`
+	LastSuccess time.Time `json:"lastSuccess"`
+	LastError   string    `json:"lastError"`
+	// Versions received by the last successful sync
+	LastCount int `json:"lastCount"`
+	// Versions added from this upstream
+	TotalCount int       `json:"totalCount"`
+	UpdatedAt  time.Time `json:"updatedAt"`
+}
+
 func fetchPackages() error {
-	rw.Lock()
-	defer rw.Unlock()
-	if lastSync+viper.GetInt64("services.sync.interval")/2 < time.Now().Unix() {
-		//Fetch packages
+	_, err := syncPackages(false)
+	return err
+}
 
-		since, err := Packages.GetPublicCount()
-		if err != nil {
-			return err
+// Syncs every upstream, unless a sync succeeded within the last half interval
+// and force is false. Returns whether a sync was attempted.
+//
+func syncPackages(force bool) (bool, error) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	if !force && lastSync+viper.GetInt64("services.sync.interval")/2 >= time.Now().Unix() {
+		return false, nil
+	}
+	status.started()
+	us, err := upstreams()
+	if err != nil {
+		status.finished(err)
+		return true, err
+	}
+	var registries []Upstream
+	var proxyErr error
+	for _, u := range us {
+		if !u.isProxy() {
+			registries = append(registries, u)
+			continue
+		}
+		if err := syncUpstream(&u, fetchProxyPackages); err != nil {
+			log.Warnf("Failed syncing from proxy %s: %s", u.Name, err)
+			proxyErr = err
+		}
+	}
+	for _, u := range registries {
+		if err = syncUpstream(&u, fetchRegistryPackages); err == nil {
+			break
 		}
+		log.Warnf("Failed syncing from %s: %s", u.Name, err)
+	}
+	if err == nil {
+		err = proxyErr
+	}
+	if err == nil {
+		lastSync = time.Now().Unix()
+	}
+	status.finished(err)
+	return true, err
+}
 
-		if since == 0 {
-			log.Debug("Initializing database for the first time.")
-			req, _ := http.NewRequest("GET", "https://package.elm-lang.org/all-packages", nil)
-			resp, err := httpClient.Do(req)
-			if err != nil {
-				return err
-			}
-			var m map[string][]string
-			dec := json.NewDecoder(resp.Body)
-			if err := dec.Decode(&m); err != nil {
-				return err
-			}
-			p := 0
-			total := int(packageVersionSum(m))
-			log.Debugf("Received %d total packages.", total)
-			pkgs := make([]Package, total)
-			for name, versions := range m {
-				for _, version := range versions {
-					pkgs[p] = Package{
-						Name:    name,
-						Version: version,
-					}
-					p += 1
-				}
+// Loads the sync state of an upstream, seeding new states from the packages
+// synchronized before states were tracked. Registry upstreams share one
+// sequence, so a registry without a cursor continues from the furthest one.
+//
+func loadSyncState(u *Upstream) (*SyncState, error) {
+	state, err := Packages.GetSyncState(u.Name)
+	if err == gorm.ErrRecordNotFound {
+		state = &SyncState{Upstream: u.Name, Type: u.kind()}
+		if u.isProxy() {
+			state.Cursor, err = Packages.GetUpstreamCursor(u.Name)
+			return state, err
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	if u.isProxy() || state.Cursor != 0 {
+		return state, nil
+	}
+	states, err := Packages.GetSyncStates()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range states {
+		if s.Type == state.Type && s.Cursor > state.Cursor {
+			state.Cursor = s.Cursor
+		}
+	}
+	if state.Cursor == 0 {
+		state.Cursor, err = Packages.GetPublicCount()
+	}
+	return state, err
+}
+
+// Fetches packages from an upstream, advancing the state's cursor past them
+//
+type upstreamFetch func(u *Upstream, state *SyncState) ([]Package, error)
+
+// Syncs an upstream, storing the packages received and its new state in one
+// transaction, or recording the failure.
+//
+func syncUpstream(u *Upstream, fetch upstreamFetch) error {
+	state, err := loadSyncState(u)
+	if err != nil {
+		return err
+	}
+	cursor := state.Cursor
+	state.LastAttempt = time.Now().UTC()
+	pkgs, err := fetch(u, state)
+	if err == nil {
+		state.LastSuccess = state.LastAttempt
+		state.LastError = ""
+		state.LastCount = len(pkgs)
+		var added []Package
+		rw.Lock()
+		if added, err = Packages.ApplySync(state, pkgs); err == nil && len(added) > 0 {
+			if serr := updateSnapshot(false); serr != nil {
+				log.Error("Failed updating registry snapshot ", serr)
 			}
-			if err := Packages.BatchCreate(pkgs); err != nil {
-				return err
+		}
+		rw.Unlock()
+		if err == nil {
+			log.Debugf("Added %d of %d package(s) received from %s", len(added), len(pkgs), u.Name)
+			// Initial imports are not reported
+			if cursor != 0 && len(added) > 0 {
+				emit(EventSynced, packagePointers(added)...)
 			}
-			lastSync = time.Now().Unix()
 			return nil
 		}
+	}
+	state.Cursor = cursor
+	state.LastError = err.Error()
+	if serr := Packages.SaveSyncState(state); serr != nil {
+		log.Error(serr)
+	}
+	return err
+}
+
+func fetchRegistryPackages(u *Upstream, state *SyncState) ([]Package, error) {
+	if state.Cursor == 0 {
+		log.Debug("Initializing database for the first time.")
+		var m map[string][]string
+		if err := u.get("/all-packages", &m); err != nil {
+			return nil, err
+		}
+		pkgs := registryPackages(m, u.Name)
+		log.Debugf("Received %d total packages from %s.", len(pkgs), u.Name)
+		state.Cursor = uint64(len(pkgs))
+		return pkgs, nil
+	}
+
+	var versions []string
+	if err := u.get(fmt.Sprintf("/all-packages/since/%d", state.Cursor), &versions); err != nil {
+		return nil, err
+	}
+	log.Debugf("Received %d new package(s) from %s", len(versions), u.Name)
+	pkgs := make([]Package, len(versions))
+	for i, v := range versions {
+		splt := strings.Split(v, "@")
+		if len(splt) != 2 {
+			return nil, fmt.Errorf("Invalid package %s received from %s", v, u.Name)
+		}
+		pkgs[i] = Package{
+			Name:     splt[0],
+			Version:  splt[1],
+			Upstream: u.Name,
+		}
+	}
+	state.Cursor += uint64(len(versions))
+	return pkgs, nil
+}
 
-		url := fmt.Sprintf("https://package.elm-lang.org/all-packages/since/%d", since)
-		log.Debug("Fetching packages with url: ", url)
-		req, _ := http.NewRequest("GET", fmt.Sprintf("https://package.elm-lang.org/all-packages/since/%d", since), nil)
-		resp, err := httpClient.Do(req)
+func registryPackages(m map[string][]string, upstream string) []Package {
+	pkgs := make([]Package, 0, packageVersionSum(m))
+	for name, versions := range m {
+		for _, version := range versions {
+			pkgs = append(pkgs, Package{
+				Name:     name,
+				Version:  version,
+				Upstream: upstream,
+			})
+		}
+	}
+	return pkgs
+}
+
+func packagePointers(pkgs []Package) []*Package {
+	out := make([]*Package, len(pkgs))
+	for i := range pkgs {
+		out[i] = &pkgs[i]
+	}
+	return out
+}
+
+// Result of comparing a registry upstream's full package list with the database
+//
+type ReconcileReport struct {
+	Upstream string `json:"upstream"`
+	Received int    `json:"received"`
+	// Upstream versions missing from the database, which were added
+	Missing int `json:"missing"`
+	// Versions from registry upstreams that the upstream no longer lists
+	Extra []string `json:"extra"`
+}
+
+// Compares the full package list of the first available registry upstream
+// with the database, adding missing versions and resetting its cursor.
+//
+func Reconcile() (*ReconcileReport, error) {
+	syncMu.Lock()
+	defer syncMu.Unlock()
+	us, err := upstreams()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range us {
+		if u.isProxy() {
+			continue
+		}
+		report, rerr := reconcileWith(&u)
+		if rerr == nil {
+			return report, nil
+		}
+		log.Warnf("Failed reconciling with %s: %s", u.Name, rerr)
+		err = rerr
+	}
+	return nil, err
+}
+
+func reconcileWith(u *Upstream) (*ReconcileReport, error) {
+	report := &ReconcileReport{Upstream: u.Name}
+	err := syncUpstream(u, func(u *Upstream, state *SyncState) ([]Package, error) {
+		var m map[string][]string
+		if err := u.get("/all-packages", &m); err != nil {
+			return nil, err
+		}
+		existing, err := Packages.GetAllPackages()
 		if err != nil {
-			return err
+			return nil, err
+		}
+		listed := make(map[string]bool)
+		for name, versions := range m {
+			for _, version := range versions {
+				listed[name+"@"+version] = true
+			}
 		}
-		dec := json.NewDecoder(resp.Body)
-		var versions []string
-		if err := dec.Decode(&versions); err != nil {
-			return err
+		known := make(map[string]bool, len(existing))
+		for _, pkg := range existing {
+			known[packageSubject(&pkg)] = true
+			if !pkg.Private && pkg.OriginID == 0 && !listed[packageSubject(&pkg)] {
+				report.Extra = append(report.Extra, packageSubject(&pkg))
+			}
 		}
-		log.Debugf("Received %d new package(s)", len(versions))
-		for _, v := range versions {
-			if _, err := Packages.AddPackageFromString(v); err != nil {
-				return err
+		var missing []Package
+		for _, pkg := range registryPackages(m, u.Name) {
+			if !known[packageSubject(&pkg)] {
+				missing = append(missing, pkg)
 			}
 		}
-		lastSync = time.Now().Unix()
+		report.Received = len(listed)
+		report.Missing = len(missing)
+		state.Cursor = uint64(len(listed))
+		return missing, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(report.Extra) > 0 {
+		log.Warnf("%d package(s) are no longer listed by %s", len(report.Extra), u.Name)
 	}
-	return nil
+	log.Infof("Reconciled with %s, added %d missing package(s)", u.Name, report.Missing)
+	return report, nil
 }
+
 func packageVersionSum(p map[string][]string) int64 {
 	var i int64
 	for _, v := range p {
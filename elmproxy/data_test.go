@@ -0,0 +1,119 @@
+package elmproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Configures a fresh database & storage directory, with upstreams pointing
+// at url, returning the database file
+//
+func configureTestStore(t *testing.T, url string) string {
+	t.Helper()
+	log.SetLevel(log.WarnLevel)
+	dir := t.TempDir()
+	viper.Reset()
+	viper.Set("services.database.file", filepath.Join(dir, "db.sqlite3"))
+	viper.Set("services.storage.dir", filepath.Join(dir, "data"))
+	viper.Set("services.sync.interval", 600)
+	viper.Set("outbound.retries", 0)
+	viper.Set("upstreams", []map[string]interface{}{{"name": "test", "url": url}})
+	return viper.GetString("services.database.file")
+}
+
+func openTestStore(t *testing.T, url string) {
+	t.Helper()
+	configureTestStore(t, url)
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateSnapshot(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Serves a request through the router, failing when it doesn't respond in time
+//
+func serveWithin(t *testing.T, path string, d time.Duration) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		Router().ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		close(done)
+	}()
+	select {
+	case <-done:
+		return rec
+	case <-time.After(d):
+		t.Fatalf("%s did not respond within %s", path, d)
+		return nil
+	}
+}
+
+func TestPackagesServedDuringSync(t *testing.T) {
+	requested := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/all-packages":
+			w.Write([]byte(`{"elm/core":["1.0.0"]}`))
+		case "/all-packages/since/1":
+			close(requested)
+			<-release
+			w.Write([]byte(`["elm/core@1.0.1"]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer upstream.Close()
+	// Unblocks the upstream before closing it, including when failing early
+	var releaseOnce sync.Once
+	unblock := func() { releaseOnce.Do(func() { close(release) }) }
+	defer unblock()
+	openTestStore(t, upstream.URL)
+
+	if _, err := syncPackages(true); err != nil {
+		t.Fatal(err)
+	}
+	synced := make(chan error, 1)
+	go func() {
+		_, err := syncPackages(true)
+		synced <- err
+	}()
+	select {
+	case <-requested:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync did not request /all-packages/since/1")
+	}
+
+	all := serveWithin(t, "/all-packages", time.Second)
+	var m map[string][]string
+	if err := json.Unmarshal(all.Body.Bytes(), &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m["elm/core"]) != 1 {
+		t.Errorf("/all-packages during a sync = %v, want elm/core 1.0.0", m)
+	}
+	since := serveWithin(t, "/all-packages/since/0", time.Second)
+	if got := since.Body.String(); got != `["elm/core@1.0.0"]` {
+		t.Errorf("/all-packages/since/0 during a sync = %s", got)
+	}
+
+	unblock()
+	if err := <-synced; err != nil {
+		t.Fatal(err)
+	}
+	since = serveWithin(t, "/all-packages/since/1", time.Second)
+	if got := since.Body.String(); got != `["elm/core@1.0.1"]` {
+		t.Errorf("/all-packages/since/1 after the sync = %s", got)
+	}
+}
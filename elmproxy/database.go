@@ -2,25 +2,48 @@ package elmproxy
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
+	// Held by syncs while storing packages and swapping in the new snapshot
 	rw       sync.RWMutex
 	Packages PackageManager = &SqlitePackageManager{}
 )
 
 func Initialize() error {
+	if err := Open(); err != nil {
+		return err
+	}
+	// Existing data is served while upstreams are unavailable, SyncWorker retries
+	if err := fetchPackages(); err != nil {
+		log.Warnf("Initial sync failed, starting degraded: %s", err)
+	}
+	return nil
+}
+
+// Opens the database & storage without synchronizing, as used by commands
+//
+func Open() error {
 	if err := Packages.Initialize(); err != nil {
 		return err
 	}
+	subscribe(queueWebhooks)
+	subscribe(snapshotListener)
+	if err := configureOutbound(); err != nil {
+		return err
+	}
 	dir := viper.GetString("services.storage.dir")
 	if _, err := os.Stat(dir); err != nil {
 		if os.IsNotExist(err) {
@@ -32,7 +55,7 @@ func Initialize() error {
 			return err
 		}
 	}
-	return fetchPackages()
+	return migrateStorage()
 }
 
 type Package struct {
@@ -41,8 +64,22 @@ type Package struct {
 	Version string `gorm:"index:pkgId,unique"`
 	Hash    string
 	Private bool
+	// Yanked packages are hidden from listings but remain downloadable
+	Yanked bool `gorm:"not null;default:false"`
+	// Packages pending approval are hidden from listings
+	Status    string `gorm:"default:published;index"`
+	Publisher string
+	// Name of the upstream the package was synchronized from
+	Upstream string
+	// Package ID on the proxy upstream the package was imported from
+	OriginID uint `gorm:"index;not null;default:0"`
 }
 
+const (
+	StatusPublished = "published"
+	StatusPending   = "pending"
+)
+
 type PrivateNamespace struct {
 	Name string `gorm:"primaryKey" json:"name"`
 }
@@ -55,19 +92,62 @@ type Endpoint struct {
 type PackageManager interface {
 	Initialize() error
 	GetPackage(name, version string) (*Package, error)
-	AddPackage(name, version string, private bool) (*Package, error)
-	AddPackageFromString(pkg string) (*Package, error)
+	AddPackage(*Package) (*Package, error)
+	AddPackageFromString(pkg, upstream string) (*Package, error)
 	GetAllPackages() ([]Package, error)
 	GetPackagesSince(since uint64) ([]Package, error)
 	BatchCreate([]Package) error
-	// Get a count of public packages
+	// Highest origin ID imported from a proxy upstream
+	GetUpstreamCursor(upstream string) (uint64, error)
+	// Sync state
+	GetSyncStates() ([]SyncState, error)
+	GetSyncState(upstream string) (*SyncState, error)
+	SaveSyncState(*SyncState) error
+	// Inserts the packages not already known and saves the state in one
+	// transaction, returning the packages inserted
+	ApplySync(*SyncState, []Package) ([]Package, error)
+	// Get a count of public packages synchronized from registry upstreams
 	//
 	GetPublicCount() (uint64, error)
 	// Private packages
 	GetPrivatePackageNamespaces() ([]PrivateNamespace, error)
 	GetPrivatePackageNamespace(namespace string) (*PrivateNamespace, error)
 	CreatePrivatePackageNamespace(name string) (*PrivateNamespace, error)
+	// Every package with stored files: private ones, including yanked &
+	// pending ones, and those imported from bundles or ELM_HOME caches
+	GetStoredPackages() ([]Package, error)
 	UpdatePackage(*Package) (*Package, error)
+	DeletePackage(*Package) error
+	// Approvals
+	GetPendingPackages() ([]Package, error)
+	ApprovePackage(*Package, *PackageReview) (*Package, error)
+	RejectPackage(*Package, *PackageReview) error
+	GetPackageReviews() ([]PackageReview, error)
+	// Approvals of a version recorded since it was submitted
+	GetPackageApprovals(name, version string, since time.Time) ([]PackageReview, error)
+	AddPackageReview(*PackageReview) error
+	// Audit log
+	AddAuditEntry(*AuditEntry) error
+	GetAuditEntries(*AuditFilter) ([]AuditEntry, error)
+	// Backups
+	// Writes a consistent copy of the database to path, while it's in use
+	BackupTo(path string) error
+	// Every package after the given ID, regardless of status
+	GetPackageRange(after uint64) ([]Package, error)
+	// Inserts packages keeping their IDs, skipping those already restored and
+	// failing when other packages hold their IDs or versions
+	RestorePackages([]Package) (int, error)
+	// Pinned public package files
+	GetPinnedFile(name, version, file string) (*PinnedFile, error)
+	// Pins a file unless it's already pinned
+	PinFile(*PinnedFile) error
+	SavePinnedFile(*PinnedFile) error
+	GetPinnedFiles(afterID uint, limit int) ([]PinnedFile, error)
+	GetTamperedFiles() ([]PinnedFile, error)
+	// Webhooks
+	QueueDeliveries([]WebhookDelivery) error
+	GetDueDeliveries(now time.Time) ([]WebhookDelivery, error)
+	UpdateDelivery(*WebhookDelivery) error
 }
 
 type SqlitePackageManager struct {
@@ -86,13 +166,82 @@ func (m *SqlitePackageManager) Initialize() error {
 	if err := db.AutoMigrate(&Package{}); err != nil {
 		return err
 	}
+	if err := migratePackages(db); err != nil {
+		return err
+	}
 	if err := db.AutoMigrate(&PrivateNamespace{}); err != nil {
 		return err
 	}
+	if err := db.AutoMigrate(&WebhookDelivery{}); err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&PackageReview{}); err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&AuditEntry{}); err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&SyncState{}); err != nil {
+		return err
+	}
+	if err := db.AutoMigrate(&PinnedFile{}); err != nil {
+		return err
+	}
 	m.db = db
 	return nil
 }
 
+// Upgrades packages tables created by earlier versions. Columns added since
+// hold NULL in existing rows, which filters comparing them never match.
+//
+func migratePackages(db *gorm.DB) error {
+	if err := migratePackageSequence(db); err != nil {
+		return err
+	}
+	if err := db.Exec("UPDATE packages SET yanked = ? WHERE yanked IS NULL", false).Error; err != nil {
+		return err
+	}
+	return db.Exec("UPDATE packages SET origin_id = 0 WHERE origin_id IS NULL").Error
+}
+
+// Package IDs are the since cursors of the registry API, event streams & proxy
+// upstreams, so they must never be reused. Without AUTOINCREMENT sqlite hands
+// out the highest ID again once its package is deleted, rejected or approved,
+// so tables created without it are rebuilt.
+//
+func migratePackageSequence(db *gorm.DB) error {
+	var schema string
+	if err := db.Raw("SELECT sql FROM sqlite_master WHERE type = 'table' AND name = 'packages'").Scan(&schema).Error; err != nil {
+		return err
+	}
+	if strings.Contains(schema, "AUTOINCREMENT") {
+		return nil
+	}
+	rebuilt := strings.Replace(schema, "`id` integer,", "`id` integer PRIMARY KEY AUTOINCREMENT,", 1)
+	rebuilt = strings.Replace(rebuilt, ",PRIMARY KEY (`id`)", "", 1)
+	if rebuilt == schema || strings.Contains(rebuilt, "PRIMARY KEY (") {
+		return errors.New("Unexpected packages table schema, can't add AUTOINCREMENT")
+	}
+	log.Info("Rebuilding the packages table so package IDs are never reused")
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("ALTER TABLE packages RENAME TO packages_rebuild").Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(rebuilt).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("INSERT INTO packages SELECT * FROM packages_rebuild").Error; err != nil {
+			return err
+		}
+		return tx.Exec("DROP TABLE packages_rebuild").Error
+	})
+	if err != nil {
+		return err
+	}
+	// Indexes were dropped along with the old table
+	return db.AutoMigrate(&Package{})
+}
+
 func (m *SqlitePackageManager) GetPackage(name, version string) (*Package, error) {
 	pkg := &Package{}
 	if err := m.db.First(pkg, "name = ? AND version = ?", name, version).Error; err != nil {
@@ -101,19 +250,14 @@ func (m *SqlitePackageManager) GetPackage(name, version string) (*Package, error
 	return pkg, nil
 }
 
-func (m *SqlitePackageManager) AddPackage(name, version string, private bool) (*Package, error) {
-	p := &Package{
-		Name:    name,
-		Version: version,
-		Private: private,
-	}
+func (m *SqlitePackageManager) AddPackage(p *Package) (*Package, error) {
 	if err := m.db.Create(p).Error; err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
-func (m *SqlitePackageManager) AddPackageFromString(pkg string) (p *Package, err error) {
+func (m *SqlitePackageManager) AddPackageFromString(pkg, upstream string) (p *Package, err error) {
 	defer func() {
 		if recover() != nil {
 			err = errors.New("Invalid string.")
@@ -123,8 +267,9 @@ func (m *SqlitePackageManager) AddPackageFromString(pkg string) (p *Package, err
 
 	splt := strings.Split(pkg, "@")
 	p = &Package{
-		Name:    splt[0],
-		Version: splt[1],
+		Name:     splt[0],
+		Version:  splt[1],
+		Upstream: upstream,
 	}
 	if err := m.db.Create(p).Error; err != nil {
 		return nil, err
@@ -134,7 +279,7 @@ func (m *SqlitePackageManager) AddPackageFromString(pkg string) (p *Package, err
 
 func (m *SqlitePackageManager) GetAllPackages() ([]Package, error) {
 	var packages []Package
-	if err := m.db.Find(&packages).Error; err != nil {
+	if err := m.db.Where("yanked = ? AND status = ?", false, StatusPublished).Find(&packages).Error; err != nil {
 		return nil, err
 	}
 	return packages, nil
@@ -142,7 +287,7 @@ func (m *SqlitePackageManager) GetAllPackages() ([]Package, error) {
 
 func (m *SqlitePackageManager) GetPackagesSince(since uint64) ([]Package, error) {
 	var packages []Package
-	if err := m.db.Model(&Package{}).Where("ID > ?", since).Find(&packages).Error; err != nil {
+	if err := m.db.Model(&Package{}).Where("ID > ? AND yanked = ? AND status = ?", since, false, StatusPublished).Order("id").Find(&packages).Error; err != nil {
 		return nil, err
 	}
 	return packages, nil
@@ -150,7 +295,9 @@ func (m *SqlitePackageManager) GetPackagesSince(since uint64) ([]Package, error)
 
 func (m *SqlitePackageManager) GetPublicCount() (uint64, error) {
 	var i int64
-	if err := m.db.Model(&Package{}).Where("Private = ?", false).Count(&i).Error; err != nil {
+	// Imports hold a subset of the registry, which would skew registry cursors
+	q := m.db.Model(&Package{}).Where("Private = ? AND origin_id = ?", false, 0)
+	if err := q.Where("upstream IS NULL OR upstream NOT IN ?", localUpstreams).Count(&i).Error; err != nil {
 		log.Error("Error get count ", err)
 		return 0, err
 	}
@@ -183,9 +330,300 @@ func (m *SqlitePackageManager) CreatePrivatePackageNamespace(namespace string) (
 	return p, nil
 }
 
+func (m *SqlitePackageManager) GetStoredPackages() ([]Package, error) {
+	var pkgs []Package
+	if err := m.db.Where("private = ? OR upstream IN ?", true, localUpstreams).Order("id").Find(&pkgs).Error; err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
+
 func (m *SqlitePackageManager) UpdatePackage(pkg *Package) (*Package, error) {
 	if err := m.db.Model(pkg).Updates(pkg).Error; err != nil {
 		return nil, err
 	}
 	return pkg, nil
 }
+
+// Rows are removed so the version can be published again, their IDs aren't
+// reused as the packages table is AUTOINCREMENT.
+//
+func (m *SqlitePackageManager) DeletePackage(pkg *Package) error {
+	return m.db.Unscoped().Delete(pkg).Error
+}
+
+func (m *SqlitePackageManager) QueueDeliveries(deliveries []WebhookDelivery) error {
+	return m.db.Create(&deliveries).Error
+}
+
+func (m *SqlitePackageManager) GetDueDeliveries(now time.Time) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	if err := m.db.Where("delivered = ? AND failed = ? AND next_attempt <= ?", false, false, now).Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+func (m *SqlitePackageManager) UpdateDelivery(d *WebhookDelivery) error {
+	return m.db.Save(d).Error
+}
+
+func (m *SqlitePackageManager) GetPendingPackages() ([]Package, error) {
+	var packages []Package
+	if err := m.db.Where("status = ?", StatusPending).Find(&packages).Error; err != nil {
+		return nil, err
+	}
+	return packages, nil
+}
+
+// Approved packages are recreated so they are appended to the package
+// sequence, rather than appearing behind clients' since cursors.
+//
+func (m *SqlitePackageManager) ApprovePackage(pkg *Package, review *PackageReview) (*Package, error) {
+	approved := &Package{
+		Name:      pkg.Name,
+		Version:   pkg.Version,
+		Hash:      pkg.Hash,
+		Private:   pkg.Private,
+		Status:    StatusPublished,
+		Publisher: pkg.Publisher,
+	}
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(pkg).Error; err != nil {
+			return err
+		}
+		if err := tx.Create(approved).Error; err != nil {
+			return err
+		}
+		return tx.Create(review).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return approved, nil
+}
+
+func (m *SqlitePackageManager) RejectPackage(pkg *Package, review *PackageReview) error {
+	return m.db.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Unscoped().Delete(pkg).Error; err != nil {
+			return err
+		}
+		return tx.Create(review).Error
+	})
+}
+
+func (m *SqlitePackageManager) GetPackageReviews() ([]PackageReview, error) {
+	var reviews []PackageReview
+	if err := m.db.Order("id desc").Find(&reviews).Error; err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+func (m *SqlitePackageManager) GetPackageApprovals(name, version string, since time.Time) ([]PackageReview, error) {
+	var reviews []PackageReview
+	if err := m.db.Where("name = ? AND version = ? AND approved = ? AND created_at >= ?", name, version, true, since).Order("id").Find(&reviews).Error; err != nil {
+		return nil, err
+	}
+	return reviews, nil
+}
+
+func (m *SqlitePackageManager) AddPackageReview(review *PackageReview) error {
+	return m.db.Create(review).Error
+}
+
+func (m *SqlitePackageManager) AddAuditEntry(e *AuditEntry) error {
+	return m.db.Create(e).Error
+}
+
+func (m *SqlitePackageManager) GetAuditEntries(f *AuditFilter) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	q := m.db.Model(&AuditEntry{}).Where("id > ?", f.AfterID)
+	if f.Action != "" {
+		q = q.Where("action = ?", f.Action)
+	}
+	if f.Actor != "" {
+		q = q.Where("actor = ?", f.Actor)
+	}
+	if f.Subject != "" {
+		q = q.Where("subject LIKE ?", f.Subject+"%")
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("created_at < ?", f.Until)
+	}
+	if err := q.Order("id").Limit(f.Limit).Find(&entries).Error; err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+func (m *SqlitePackageManager) GetUpstreamCursor(upstream string) (uint64, error) {
+	var cursor uint64
+	if err := m.db.Model(&Package{}).Select("COALESCE(MAX(origin_id), 0)").Where("upstream = ?", upstream).Scan(&cursor).Error; err != nil {
+		return 0, err
+	}
+	return cursor, nil
+}
+
+func (m *SqlitePackageManager) GetSyncStates() ([]SyncState, error) {
+	var states []SyncState
+	if err := m.db.Find(&states).Error; err != nil {
+		return nil, err
+	}
+	return states, nil
+}
+
+func (m *SqlitePackageManager) GetSyncState(upstream string) (*SyncState, error) {
+	state := &SyncState{}
+	if err := m.db.First(state, "upstream = ?", upstream).Error; err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (m *SqlitePackageManager) SaveSyncState(state *SyncState) error {
+	return m.db.Save(state).Error
+}
+
+func (m *SqlitePackageManager) ApplySync(state *SyncState, pkgs []Package) ([]Package, error) {
+	var added []Package
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		added = nil
+		// Known versions are left out rather than conflicting, as every
+		// attempted insert takes an ID
+		known, err := knownVersions(tx, pkgs)
+		if err != nil {
+			return err
+		}
+		for i := range pkgs {
+			if known[packageSubject(&pkgs[i])] {
+				continue
+			}
+			known[packageSubject(&pkgs[i])] = true
+			res := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&pkgs[i])
+			if res.Error != nil {
+				return res.Error
+			}
+			if res.RowsAffected > 0 {
+				added = append(added, pkgs[i])
+			}
+		}
+		state.TotalCount += len(added)
+		return tx.Save(state).Error
+	})
+	if err != nil {
+		state.TotalCount -= len(added)
+		return nil, err
+	}
+	return added, nil
+}
+
+// Versions of the given packages already stored, as name@version
+//
+func knownVersions(tx *gorm.DB, pkgs []Package) (map[string]bool, error) {
+	names := make(map[string]bool)
+	for i := range pkgs {
+		names[pkgs[i].Name] = true
+	}
+	batch := make([]string, 0, len(names))
+	for name := range names {
+		batch = append(batch, name)
+	}
+	known := make(map[string]bool)
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > 500 {
+			n = 500
+		}
+		var rows []Package
+		if err := tx.Unscoped().Select("name", "version").Where("name IN ?", batch[:n]).Find(&rows).Error; err != nil {
+			return nil, err
+		}
+		for i := range rows {
+			known[packageSubject(&rows[i])] = true
+		}
+		batch = batch[n:]
+	}
+	return known, nil
+}
+
+func (m *SqlitePackageManager) GetPinnedFile(name, version, file string) (*PinnedFile, error) {
+	pin := &PinnedFile{}
+	if err := m.db.First(pin, "name = ? AND version = ? AND file = ?", name, version, file).Error; err != nil {
+		return nil, err
+	}
+	return pin, nil
+}
+
+func (m *SqlitePackageManager) PinFile(pin *PinnedFile) error {
+	return m.db.Clauses(clause.OnConflict{DoNothing: true}).Create(pin).Error
+}
+
+func (m *SqlitePackageManager) SavePinnedFile(pin *PinnedFile) error {
+	return m.db.Save(pin).Error
+}
+
+func (m *SqlitePackageManager) GetPinnedFiles(afterID uint, limit int) ([]PinnedFile, error) {
+	var pins []PinnedFile
+	if err := m.db.Where("id > ?", afterID).Order("id").Limit(limit).Find(&pins).Error; err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+func (m *SqlitePackageManager) GetTamperedFiles() ([]PinnedFile, error) {
+	var pins []PinnedFile
+	if err := m.db.Where("tampered_at IS NOT NULL").Order("tampered_at desc").Find(&pins).Error; err != nil {
+		return nil, err
+	}
+	return pins, nil
+}
+
+func (m *SqlitePackageManager) BackupTo(path string) error {
+	return m.db.Exec("VACUUM INTO ?", path).Error
+}
+
+func (m *SqlitePackageManager) GetPackageRange(after uint64) ([]Package, error) {
+	var pkgs []Package
+	if err := m.db.Where("id > ?", after).Order("id").Find(&pkgs).Error; err != nil {
+		return nil, err
+	}
+	return pkgs, nil
+}
+
+func (m *SqlitePackageManager) RestorePackages(pkgs []Package) (int, error) {
+	restored := 0
+	err := m.db.Transaction(func(tx *gorm.DB) error {
+		restored = 0
+		var conflicts []string
+		for i := range pkgs {
+			pkg := &pkgs[i]
+			var existing []Package
+			if err := tx.Unscoped().Where("id = ? OR (name = ? AND version = ?)", pkg.ID, pkg.Name, pkg.Version).Find(&existing).Error; err != nil {
+				return err
+			}
+			if len(existing) == 1 && existing[0].ID == pkg.ID && packageSubject(&existing[0]) == packageSubject(pkg) {
+				continue
+			}
+			if len(existing) > 0 {
+				conflicts = append(conflicts, strconv.FormatUint(uint64(pkg.ID), 10))
+				continue
+			}
+			if err := tx.Create(pkg).Error; err != nil {
+				return err
+			}
+			restored += 1
+		}
+		if len(conflicts) > 0 {
+			return fmt.Errorf("Packages created since the backup conflict with backed up package IDs %s", strings.Join(conflicts, ", "))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return restored, nil
+}
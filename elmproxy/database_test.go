@@ -0,0 +1,168 @@
+package elmproxy
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+// Schema & rows of a database created before packages could be yanked,
+// approved, synchronized from several upstreams or imported
+//
+var baselineSchema = []string{
+	"CREATE TABLE `packages` (`id` integer,`created_at` datetime,`updated_at` datetime,`deleted_at` datetime,`name` text,`version` text,`hash` text,`private` numeric,PRIMARY KEY (`id`))",
+	"CREATE INDEX `idx_packages_deleted_at` ON `packages`(`deleted_at`)",
+	"CREATE UNIQUE INDEX `pkgId` ON `packages`(`name`,`version`)",
+	"CREATE TABLE `private_namespaces` (`name` text,PRIMARY KEY (`name`))",
+	"INSERT INTO packages (id, name, version, private) VALUES (1, 'elm/core', '1.0.0', false), (2, 'acme/lib', '1.0.0', true)",
+}
+
+func TestUpgradeBaselineDatabase(t *testing.T) {
+	file := configureTestStore(t, "http://127.0.0.1:1")
+	db, err := gorm.Open(sqlite.Open(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range baselineSchema {
+		if err := db.Exec(stmt).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Columns added by earlier upgrades, without defaults
+	for _, column := range []string{"`yanked` numeric", "`origin_id` integer"} {
+		if err := db.Exec("ALTER TABLE packages ADD COLUMN " + column).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	sqlDB, _ := db.DB()
+	sqlDB.Close()
+
+	if err := Open(); err != nil {
+		t.Fatal(err)
+	}
+	pkgs, err := Packages.GetAllPackages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pkgs) != 2 {
+		t.Errorf("listed %d of the 2 upgraded packages", len(pkgs))
+	}
+	since, err := Packages.GetPackagesSince(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(since) != 2 {
+		t.Errorf("%d upgraded package(s) since 0, want 2", len(since))
+	}
+
+	// Registry cursors are seeded from the public count
+	if count, err := Packages.GetPublicCount(); err != nil || count != 1 {
+		t.Errorf("public count %d (%v), want 1", count, err)
+	}
+
+	// Deleted IDs aren't handed out again
+	latest, err := Packages.GetPackage("acme/lib", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Packages.DeletePackage(latest); err != nil {
+		t.Fatal(err)
+	}
+	added, err := Packages.AddPackage(&Package{Name: "acme/lib", Version: "1.0.1", Private: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added.ID != 3 {
+		t.Errorf("added package got ID %d, want 3", added.ID)
+	}
+}
+
+func TestApplySyncSkipsKnownVersions(t *testing.T) {
+	openTestStore(t, "http://127.0.0.1:1")
+	state := &SyncState{Upstream: "test", Type: "registry"}
+	if _, err := Packages.ApplySync(state, []Package{{Name: "a/b", Version: "1.0.0"}}); err != nil {
+		t.Fatal(err)
+	}
+	added, err := Packages.ApplySync(state, []Package{
+		{Name: "a/b", Version: "1.0.0"},
+		{Name: "a/b", Version: "1.0.1"},
+		{Name: "a/b", Version: "1.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0].Version != "1.0.1" {
+		t.Fatalf("added %v, want a/b@1.0.1", added)
+	}
+	if added[0].ID != 2 {
+		t.Errorf("a/b@1.0.1 got ID %d, want 2", added[0].ID)
+	}
+	if state.TotalCount != 2 {
+		t.Errorf("total count %d, want 2", state.TotalCount)
+	}
+}
+
+func TestSinceCountsListedVersions(t *testing.T) {
+	openTestStore(t, "http://127.0.0.1:1")
+	viper.Set("approval.namespaces", []string{"acme"})
+	if _, err := addPrivatePackage("acme/lib", "1.0.0", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	state := &SyncState{Upstream: "test", Type: "registry"}
+	if _, err := Packages.ApplySync(state, []Package{{Name: "a/b", Version: "1.0.0"}, {Name: "a/b", Version: "1.0.1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateSnapshot(false); err != nil {
+		t.Fatal(err)
+	}
+	snap, err := currentSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The pending version isn't counted
+	if got := snap.since(1); len(got) != 1 || got[0] != "a/b@1.0.1" {
+		t.Errorf("since 1 = %v, want [a/b@1.0.1]", got)
+	}
+
+	pending, err := Packages.GetPackage("acme/lib", "1.0.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	approved, err := Packages.ApprovePackage(pending, &PackageReview{Name: "acme/lib", Version: "1.0.0", Reviewer: "bob", Approved: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	emit(EventPublished, approved)
+	snap, _ = currentSnapshot()
+	if got := snap.since(2); len(got) != 1 || got[0] != "acme/lib@1.0.0" {
+		t.Errorf("since 2 after approval = %v, want [acme/lib@1.0.0]", got)
+	}
+	if got := snap.since(3); len(got) != 0 {
+		t.Errorf("since 3 = %v, want none", got)
+	}
+}
+
+func TestRestorePackagesConflicts(t *testing.T) {
+	openTestStore(t, "http://127.0.0.1:1")
+	if _, err := Packages.AddPackage(&Package{Name: "a/b", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	// Restoring the same archive again is a no-op
+	if n, err := Packages.RestorePackages([]Package{{Model: gorm.Model{ID: 1}, Name: "a/b", Version: "1.0.0"}}); n != 0 || err != nil {
+		t.Errorf("restored %d again (%v), want 0", n, err)
+	}
+	_, err := Packages.RestorePackages([]Package{
+		{Model: gorm.Model{ID: 2}, Name: "c/d", Version: "1.0.0"},
+		{Model: gorm.Model{ID: 1}, Name: "x/y", Version: "1.0.0"},
+		{Model: gorm.Model{ID: 3}, Name: "a/b", Version: "1.0.0"},
+	})
+	if err == nil || !strings.HasSuffix(err.Error(), "IDs 1, 3") {
+		t.Fatalf("got %v, want a conflict on IDs 1, 3", err)
+	}
+	if _, err := Packages.GetPackage("c/d", "1.0.0"); err == nil {
+		t.Error("packages were restored despite the conflict")
+	}
+}
@@ -0,0 +1,317 @@
+package elmproxy
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Package cache of the compiler within ELM_HOME
+//
+const elmHomePackages = "0.19.1/packages"
+
+// Modification time of every rebuilt archive entry, so rebuilding a source
+// tree always produces the same archive.
+//
+var rebuiltModTime = time.Date(2019, 10, 21, 0, 0, 0, 0, time.UTC)
+
+type ImportIssue struct {
+	Package string `json:"package"`
+	Problem string `json:"problem"`
+}
+
+// Result of importing an ELM_HOME package cache
+//
+type ElmHomeReport struct {
+	// Source trees found
+	Packages int `json:"packages"`
+	// Versions added to the registry, the others were already known
+	Added []string `json:"added"`
+	// Versions whose rebuilt archive isn't byte for byte the registry's, served
+	// with an endpoint.json hashing the rebuilt archive
+	Flagged []ImportIssue `json:"flagged"`
+	// Versions left out
+	Skipped []ImportIssue `json:"skipped"`
+}
+
+// Imports the package source trees of an ELM_HOME directory, or of its
+// 0.19.1/packages directory. Only versions listed by its registry.dat are
+// imported, with archives rebuilt from their sources. Unless offline, the
+// registry is asked for hashes of archives not already pinned. Imports are
+// audited as made by actor.
+//
+func ImportElmHome(dir string, offline bool, actor string) (*ElmHomeReport, error) {
+	if _, err := os.Stat(filepath.Join(dir, "registry.dat")); err != nil {
+		dir = filepath.Join(dir, filepath.FromSlash(elmHomePackages))
+	}
+	registry, err := readElmRegistry(filepath.Join(dir, "registry.dat"))
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ElmHomeReport{Added: []string{}, Flagged: []ImportIssue{}, Skipped: []ImportIssue{}}
+	var trees []BundlePackage
+	for _, path := range paths {
+		rel, _ := filepath.Rel(dir, path)
+		rel = filepath.ToSlash(rel)
+		i := strings.LastIndex(rel, "/")
+		name, version := rel[:i], rel[i+1:]
+		if info, err := os.Stat(path); err != nil || !info.IsDir() {
+			continue
+		}
+		if _, ok := parseVersion(version); !ok {
+			continue
+		}
+		trees = append(trees, BundlePackage{Name: name, Version: version})
+	}
+	// Versions of a package are added in ascending order, as published
+	sort.Slice(trees, func(i, j int) bool {
+		if trees[i].Name != trees[j].Name {
+			return trees[i].Name < trees[j].Name
+		}
+		a, _ := parseVersion(trees[i].Version)
+		b, _ := parseVersion(trees[j].Version)
+		return compareVersions(a, b) < 0
+	})
+	report.Packages = len(trees)
+
+	var bps []BundlePackage
+	files := make(map[string]map[string][]byte)
+	for _, bp := range trees {
+		subject := packageId(bp.Name, bp.Version)
+		if !registry[subject] {
+			report.Skipped = append(report.Skipped, ImportIssue{subject, "not listed by registry.dat"})
+			continue
+		}
+		if pkg, err := Packages.GetPackage(bp.Name, bp.Version); err == nil && pkg.Private {
+			report.Skipped = append(report.Skipped, ImportIssue{subject, "a private package has the same name"})
+			continue
+		}
+		if _, _, err := readPackageFile(bp.Name, bp.Version, packageArchiveFile); err == nil {
+			report.Skipped = append(report.Skipped, ImportIssue{subject, "archive already stored"})
+			continue
+		}
+		pkgFiles, problem, err := rebuildPackage(filepath.Join(dir, filepath.FromSlash(bp.Name), bp.Version), bp.Name, bp.Version, offline)
+		if err != nil {
+			report.Skipped = append(report.Skipped, ImportIssue{subject, err.Error()})
+			continue
+		}
+		if problem != "" {
+			log.Warnf("Rebuilt archive of %s is not the registry's: %s", subject, problem)
+			report.Flagged = append(report.Flagged, ImportIssue{subject, problem})
+		}
+		bp.Files = make(map[string]string, len(pkgFiles))
+		for file, b := range pkgFiles {
+			bp.Files[file] = digestOf(b)
+		}
+		bps = append(bps, bp)
+		files[subject] = pkgFiles
+	}
+
+	if report.Added, err = addStoredPackages(elmHomeUpstream, bps, files); err != nil {
+		return nil, err
+	}
+	log.Infof("Imported %d of %d package(s) from %s, %d new, %d flagged", len(bps), report.Packages, dir, len(report.Added), len(report.Flagged))
+	recordAudit(newAuditEntry(AuditBundleImport, actor, "", elmHomeUpstream, nil, report))
+	return report, nil
+}
+
+// Rebuilds the archive of a source tree, along with its elm.json &
+// endpoint.json. Returns why the archive isn't the registry's, if it isn't.
+//
+func rebuildPackage(dir, name, version string, offline bool) (map[string][]byte, string, error) {
+	elmJson, err := ioutil.ReadFile(filepath.Join(dir, "elm.json"))
+	if err != nil {
+		return nil, "", err
+	}
+	if err := checkElmJson(&Package{Name: name, Version: version}, elmJson); err != nil {
+		return nil, "", fmt.Errorf("elm.json is %s", err)
+	}
+	archive, err := rebuildArchive(dir, strings.Replace(name, "/", "-", 1)+"-"+version)
+	if err != nil {
+		return nil, "", err
+	}
+	h := sha1.Sum(archive)
+	e := Endpoint{Url: getZipballUrl(name, version), Hash: hex.EncodeToString(h[:])}
+
+	problem := "the registry's archive hash is unknown"
+	if registryEndpoint, err := registryPackageFile(name, version, "endpoint.json", offline); err == nil {
+		var re Endpoint
+		if err := json.Unmarshal(registryEndpoint, &re); err != nil {
+			return nil, "", fmt.Errorf("registry endpoint.json is invalid: %s", err)
+		}
+		e.Url = re.Url
+		if re.Hash == e.Hash {
+			problem = ""
+		} else {
+			problem = fmt.Sprintf("hashes to %s, the registry's to %s", e.Hash, re.Hash)
+		}
+	}
+	if registryElmJson, err := registryPackageFile(name, version, "elm.json", offline); err == nil && !bytes.Equal(registryElmJson, elmJson) {
+		return nil, "", fmt.Errorf("elm.json differs from the registry's")
+	}
+
+	endpoint, err := json.Marshal(e)
+	if err != nil {
+		return nil, "", err
+	}
+	return map[string][]byte{
+		"elm.json":         elmJson,
+		"endpoint.json":    endpoint,
+		packageArchiveFile: archive,
+	}, problem, nil
+}
+
+// Pinned copy of a public package file, fetched from the registry unless offline
+//
+func registryPackageFile(name, version, file string, offline bool) ([]byte, error) {
+	pin, err := Packages.GetPinnedFile(name, version, file)
+	if err == nil {
+		return pin.Content, nil
+	}
+	if offline {
+		return nil, err
+	}
+	return fetchRegistryFile(name, version, file)
+}
+
+// Zips the files the compiler keeps of a package archive, within a single top
+// level directory as github does. The compiler skips the first entry when
+// extracting, which must be that directory.
+//
+func rebuildArchive(dir, root string) ([]byte, error) {
+	var files []string
+	for _, file := range []string{"elm.json", "LICENSE", "README.md"} {
+		if _, err := os.Stat(filepath.Join(dir, file)); err == nil {
+			files = append(files, file)
+		}
+	}
+	err := filepath.Walk(filepath.Join(dir, "src"), func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			rel, _ := filepath.Rel(dir, path)
+			files = append(files, filepath.ToSlash(rel))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	if _, err := zw.CreateHeader(&zip.FileHeader{Name: root + "/", Modified: rebuiltModTime}); err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: root + "/" + file, Method: zip.Deflate, Modified: rebuiltModTime})
+		if err != nil {
+			return nil, err
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(file)))
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(b); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Reads the versions listed by a registry.dat, as written by the compiler
+// with Data.Binary: a count and a map of package names to their newest
+// version followed by a list of previous versions.
+//
+func readElmRegistry(path string) (map[string]bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := &elmBinaryReader{r: bufio.NewReader(f)}
+	r.int64() // count
+	names := r.int64()
+	versions := make(map[string]bool)
+	for i := int64(0); i < names && r.err == nil; i++ {
+		name := r.string() + "/" + r.string()
+		versions[name+"@"+r.version()] = true
+		previous := r.int64()
+		for j := int64(0); j < previous && r.err == nil; j++ {
+			versions[name+"@"+r.version()] = true
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("Invalid registry.dat: %w", r.err)
+	}
+	return versions, nil
+}
+
+// Decodes Data.Binary values, keeping the first error
+//
+type elmBinaryReader struct {
+	r   io.Reader
+	err error
+}
+
+func (r *elmBinaryReader) read(v interface{}) {
+	if r.err == nil {
+		r.err = binary.Read(r.r, binary.BigEndian, v)
+	}
+}
+
+func (r *elmBinaryReader) int64() int64 {
+	var n int64
+	r.read(&n)
+	if n < 0 && r.err == nil {
+		r.err = fmt.Errorf("negative length %d", n)
+	}
+	return n
+}
+
+func (r *elmBinaryReader) string() string {
+	var n uint8
+	r.read(&n)
+	b := make([]byte, n)
+	r.read(b)
+	return string(b)
+}
+
+// Versions are three bytes, or 255 followed by three 16 bit numbers
+//
+func (r *elmBinaryReader) version() string {
+	var major uint8
+	r.read(&major)
+	if major == 255 {
+		var v [3]uint16
+		r.read(&v)
+		return fmt.Sprintf("%d.%d.%d", v[0], v[1], v[2])
+	}
+	var v [2]uint8
+	r.read(&v)
+	return fmt.Sprintf("%d.%d.%d", major, v[0], v[1])
+}
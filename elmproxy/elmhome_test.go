@@ -0,0 +1,108 @@
+package elmproxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Encodes a registry.dat as the compiler does, newest version first
+//
+func elmRegistryFixture(packages map[string][]string) []byte {
+	var buf bytes.Buffer
+	write := func(v interface{}) { binary.Write(&buf, binary.BigEndian, v) }
+	version := func(s string) {
+		v, _ := parseVersion(s)
+		if v[0] < 255 && v[1] < 256 && v[2] < 256 {
+			write([3]uint8{uint8(v[0]), uint8(v[1]), uint8(v[2])})
+			return
+		}
+		write(uint8(255))
+		write([3]uint16{uint16(v[0]), uint16(v[1]), uint16(v[2])})
+	}
+	var count int64
+	for _, versions := range packages {
+		count += int64(len(versions))
+	}
+	write(count)
+	write(int64(len(packages)))
+	for name, versions := range packages {
+		for _, part := range bytes.SplitN([]byte(name), []byte("/"), 2) {
+			write(uint8(len(part)))
+			write(part)
+		}
+		version(versions[0])
+		write(int64(len(versions) - 1))
+		for _, v := range versions[1:] {
+			version(v)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestReadElmRegistry(t *testing.T) {
+	dat := elmRegistryFixture(map[string][]string{
+		"elm/core":   {"1.0.5", "1.0.2", "1.0.0"},
+		"acme/large": {"300.0.1"},
+	})
+	path := filepath.Join(t.TempDir(), "registry.dat")
+	if err := ioutil.WriteFile(path, dat, 0644); err != nil {
+		t.Fatal(err)
+	}
+	versions, err := readElmRegistry(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"elm/core@1.0.5", "elm/core@1.0.2", "elm/core@1.0.0", "acme/large@300.0.1"} {
+		if !versions[id] {
+			t.Errorf("%s not listed by registry.dat", id)
+		}
+	}
+	if len(versions) != 4 {
+		t.Errorf("listed %d versions, want 4: %v", len(versions), versions)
+	}
+
+	if err := ioutil.WriteFile(path, dat[:len(dat)-3], 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readElmRegistry(path); err == nil {
+		t.Error("Read a truncated registry.dat")
+	}
+}
+
+func TestImportElmHomeAudited(t *testing.T) {
+	openTestStore(t, "http://127.0.0.1:1")
+	dir := filepath.Join(t.TempDir(), filepath.FromSlash(elmHomePackages))
+	tree := filepath.Join(dir, "elm", "core", "1.0.5")
+	if err := os.MkdirAll(filepath.Join(tree, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{
+		filepath.Join(dir, "registry.dat"):       elmRegistryFixture(map[string][]string{"elm/core": {"1.0.5"}}),
+		filepath.Join(tree, "elm.json"):          []byte(`{"type": "package", "name": "elm/core", "version": "1.0.5", "exposed-modules": ["Basics"]}`),
+		filepath.Join(tree, "src", "Basics.elm"): []byte("module Basics exposing (..)\n"),
+	}
+	for path, content := range files {
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := ImportElmHome(filepath.Dir(filepath.Dir(dir)), true, "cli")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != 1 || len(report.Flagged) != 1 {
+		t.Errorf("import added %v & flagged %v, want elm/core@1.0.5 in both", report.Added, report.Flagged)
+	}
+	entries, err := Packages.GetAuditEntries(&AuditFilter{Action: AuditBundleImport, Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Actor != "cli" || entries[0].Subject != elmHomeUpstream {
+		t.Errorf("audited %+v, want a single import of %s by cli", entries, elmHomeUpstream)
+	}
+}
@@ -0,0 +1,172 @@
+package elmproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type EventType string
+
+const (
+	EventPublished EventType = "package.published"
+	EventYanked    EventType = "package.yanked"
+	EventDeleted   EventType = "package.deleted"
+	EventSynced    EventType = "registry.synced"
+	// Upstream content of a public package changed after it was pinned
+	EventTampered EventType = "package.tampered"
+)
+
+// Change to the registry
+//
+type Event struct {
+	Type     EventType      `json:"type"`
+	Time     time.Time      `json:"time"`
+	Packages []EventPackage `json:"packages"`
+}
+
+type EventPackage struct {
+	ID      uint   `json:"id"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+	Private bool   `json:"private"`
+}
+
+func newEventPackage(pkg *Package) EventPackage {
+	return EventPackage{
+		ID:      pkg.ID,
+		Name:    pkg.Name,
+		Version: pkg.Version,
+		Private: pkg.Private,
+	}
+}
+
+var (
+	listenersMu  sync.RWMutex
+	listeners    = make(map[int]func(Event))
+	nextListener int
+)
+
+// Registers a function called with every emitted event, returning a function
+// removing it. Listeners are called synchronously and must not block.
+//
+func subscribe(f func(Event)) func() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+	id := nextListener
+	nextListener += 1
+	listeners[id] = f
+	return func() {
+		listenersMu.Lock()
+		defer listenersMu.Unlock()
+		delete(listeners, id)
+	}
+}
+
+func emit(t EventType, pkgs ...*Package) {
+	e := Event{
+		Type:     t,
+		Time:     time.Now().UTC(),
+		Packages: make([]EventPackage, len(pkgs)),
+	}
+	for i, pkg := range pkgs {
+		e.Packages[i] = newEventPackage(pkg)
+	}
+	listenersMu.RLock()
+	defer listenersMu.RUnlock()
+	for _, f := range listeners {
+		f(e)
+	}
+}
+
+// Server-Sent Events stream of package additions & removals.
+//
+// Additions carry the package ID as the event id, which lets clients resume
+// with Last-Event-ID. Missed additions are replayed from the package sequence,
+// removals are only sent live.
+//
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming is not supported.", 501)
+		return
+	}
+	lastId := r.Header.Get("Last-Event-ID")
+	if lastId == "" {
+		lastId = r.URL.Query().Get("since")
+	}
+	cursor, _ := strconv.ParseUint(lastId, 10, 64)
+
+	// Subscribe before replaying so nothing is missed in between
+	events := make(chan Event, 64)
+	overflow := make(chan struct{})
+	var overflowOnce sync.Once
+	unsubscribe := subscribe(func(e Event) {
+		select {
+		case events <- e:
+		default:
+			// Slow clients are disconnected, and resume with Last-Event-ID.
+			// Emitters may call this concurrently.
+			overflowOnce.Do(func() { close(overflow) })
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	if lastId != "" {
+		pkgs, err := Packages.GetPackagesSince(cursor)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		for _, pkg := range pkgs {
+			writeSSE(w, "added", newEventPackage(&pkg))
+			cursor = uint64(pkg.ID)
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(time.Second * 30)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-overflow:
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case e := <-events:
+			for _, pkg := range e.Packages {
+				switch e.Type {
+				case EventPublished, EventSynced:
+					if uint64(pkg.ID) <= cursor {
+						continue
+					}
+					writeSSE(w, "added", pkg)
+					cursor = uint64(pkg.ID)
+				case EventYanked, EventDeleted:
+					writeSSE(w, "removed", pkg)
+				}
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, pkg EventPackage) {
+	b, _ := json.Marshal(pkg)
+	// Removals keep the client's cursor on the latest addition
+	if event == "added" {
+		fmt.Fprintf(w, "id: %d\n", pkg.ID)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b)
+}
@@ -0,0 +1,115 @@
+package elmproxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// Package as listed to federated proxies
+//
+type FederatedPackage struct {
+	ID       uint   `json:"id"`
+	Name     string `json:"name"`
+	Version  string `json:"version"`
+	Private  bool   `json:"private"`
+	Upstream string `json:"upstream"`
+}
+
+// Lists packages after the given id, including private packages, for proxies
+// using this one as an upstream. Requires a token under credentials.federation.
+//
+func federatedPackages(w http.ResponseWriter, r *http.Request) {
+	since, _ := strconv.ParseUint(mux.Vars(r)["id"], 10, 64)
+	pkgs, err := Packages.GetPackagesSince(since)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	out := make([]FederatedPackage, len(pkgs))
+	for i, pkg := range pkgs {
+		out[i] = FederatedPackage{
+			ID:       pkg.ID,
+			Name:     pkg.Name,
+			Version:  pkg.Version,
+			Private:  pkg.Private,
+			Upstream: pkg.Upstream,
+		}
+	}
+	writeJson(w, out)
+}
+
+// Fetches packages from another elm-package-proxy, after the highest origin
+// id received from it.
+//
+func fetchProxyPackages(u *Upstream, state *SyncState) ([]Package, error) {
+	var fps []FederatedPackage
+	if err := u.get(fmt.Sprintf("/federation/packages/since/%d", state.Cursor), &fps); err != nil {
+		return nil, err
+	}
+	log.Debugf("Received %d package(s) from proxy %s", len(fps), u.Name)
+	pkgs := make([]Package, len(fps))
+	for i, fp := range fps {
+		pkgs[i] = Package{
+			Name:     fp.Name,
+			Version:  fp.Version,
+			Private:  fp.Private,
+			Upstream: u.Name,
+			OriginID: fp.ID,
+		}
+		if uint64(fp.ID) > state.Cursor {
+			state.Cursor = uint64(fp.ID)
+		}
+	}
+	return pkgs, nil
+}
+
+// Fetches a file of a private package imported from another proxy, caching it
+// locally. Files the origin doesn't have are reported as not existing.
+//
+func fetchOriginFile(name, version, file string) ([]byte, error) {
+	pkg, err := Packages.GetPackage(name, version)
+	if err != nil || !pkg.Private || pkg.OriginID == 0 {
+		return nil, os.ErrNotExist
+	}
+	us, err := upstreams()
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range us {
+		if u.Name != pkg.Upstream {
+			continue
+		}
+		b, err := u.fetch(opMirror, fmt.Sprintf("/packages/%s/%s/%s", name, version, file))
+		var serr *StatusError
+		if errors.As(err, &serr) && serr.Code == 404 {
+			return nil, os.ErrNotExist
+		} else if err != nil {
+			return nil, err
+		}
+		if err := storePackageFiles(name, version, map[string][]byte{file: b}); err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	log.Warnf("%s@%s was imported from %s, which is no longer configured", name, version, pkg.Upstream)
+	return nil, os.ErrNotExist
+}
+
+func (u *Upstream) isProxy() bool {
+	return strings.EqualFold(u.Type, "proxy")
+}
+
+func (u *Upstream) kind() string {
+	if u.isProxy() {
+		return "proxy"
+	}
+	return "registry"
+}
@@ -0,0 +1,74 @@
+package elmproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestOriginServesPackageArchive(t *testing.T) {
+	openTestStore(t, "http://127.0.0.1:1")
+	viper.Set("credentials.federation", []map[string]interface{}{{"name": "downstream", "token": "secret"}})
+	if _, err := Packages.AddPackage(&Package{Name: "acme/lib", Version: "1.0.0", Private: true, Status: StatusPublished}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storePackageFiles("acme/lib", "1.0.0", map[string][]byte{packageArchiveFile: []byte("archive")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		path, token string
+		code        int
+		body        string
+	}{
+		{"/packages/acme/lib/1.0.0/package.zip", "secret", 200, "archive"},
+		{"/packages/acme/lib/1.0.0/package.zip", "", 401, ""},
+		{"/packages/acme/lib/1.0.1/package.zip", "secret", 404, ""},
+	} {
+		r := httptest.NewRequest("GET", tc.path, nil)
+		if tc.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		rec := httptest.NewRecorder()
+		Router().ServeHTTP(rec, r)
+		if rec.Code != tc.code || (tc.body != "" && rec.Body.String() != tc.body) {
+			t.Errorf("%s with token %q = %d %q, want %d %q", tc.path, tc.token, rec.Code, rec.Body.String(), tc.code, tc.body)
+		}
+	}
+}
+
+func TestArchiveFetchedFromOrigin(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/packages/acme/lib/1.0.0/package.zip" || r.Header.Get("Authorization") != "Bearer secret" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("archive"))
+	}))
+	defer origin.Close()
+	openTestStore(t, "http://127.0.0.1:1")
+	viper.Set("upstreams", []map[string]interface{}{{"name": "origin", "url": origin.URL, "type": "proxy", "token": "secret"}})
+	for _, version := range []string{"1.0.0", "1.0.1"} {
+		pkg := &Package{Name: "acme/lib", Version: version, Private: true, Status: StatusPublished, Upstream: "origin", OriginID: 7}
+		if _, err := Packages.AddPackage(pkg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	serveArchive(rec, httptest.NewRequest("GET", "/acme/lib/zipball/1.0.0/", nil))
+	if rec.Code != 200 || rec.Body.String() != "archive" {
+		t.Errorf("archive = %d %q, want the origin's", rec.Code, rec.Body.String())
+	}
+	if b, _, err := readPackageFile("acme/lib", "1.0.0", packageArchiveFile); err != nil || string(b) != "archive" {
+		t.Errorf("archive wasn't stored locally: %v", err)
+	}
+
+	// Archives the origin doesn't have are left to the default route
+	rec = httptest.NewRecorder()
+	serveArchive(rec, httptest.NewRequest("GET", "/acme/lib/zipball/1.0.1/", nil))
+	if rec.Body.Len() != 0 || rec.Code != 200 {
+		t.Errorf("missing archive = %d %q, want nothing written", rec.Code, rec.Body.String())
+	}
+}
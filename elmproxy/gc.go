@@ -0,0 +1,218 @@
+package elmproxy
+
+import (
+	"bufio"
+	"context"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Bytes of cached responses kept by the latest GC
+//
+var cacheBytes = expvar.NewInt("cache_bytes")
+
+var packageUrlRe = regexp.MustCompile(`^/packages/([^/]+/[^/]+)/([^/]+)/`)
+
+// Last access of cached responses, kept in memory and written to their
+// modification times at most every minute and before collecting garbage,
+// instead of touching files on every request.
+//
+type accessTracker struct {
+	mu        sync.Mutex
+	accessed  map[string]time.Time
+	lastFlush time.Time
+}
+
+var cacheAccess = &accessTracker{accessed: make(map[string]time.Time), lastFlush: time.Now()}
+
+func (t *accessTracker) touch(file string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.accessed[file] = time.Now()
+	if time.Since(t.lastFlush) > time.Minute {
+		t.lastFlush = time.Now()
+		go t.flush()
+	}
+}
+
+func (t *accessTracker) flush() {
+	t.mu.Lock()
+	accessed := t.accessed
+	t.accessed = make(map[string]time.Time)
+	t.lastFlush = time.Now()
+	t.mu.Unlock()
+	for file, at := range accessed {
+		if err := os.Chtimes(file, at, at); err != nil && !os.IsNotExist(err) {
+			log.Error("Failed recording cache access ", err)
+		}
+	}
+}
+
+type GCReport struct {
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	DryRun       bool      `json:"dryRun"`
+	Entries      int       `json:"entries"`
+	Bytes        int64     `json:"bytes"`
+	Evicted      int       `json:"evicted"`
+	EvictedBytes int64     `json:"evictedBytes"`
+	// Entries of pinned or private packages, never evicted
+	Exempt int `json:"exempt"`
+}
+
+type cacheEntry struct {
+	file     string
+	size     int64
+	accessed time.Time
+}
+
+// Evicts cached responses not accessed within services.gc.maxAge days, then
+// the least recently accessed until they fit services.gc.maxSize bytes.
+// Responses of packages under services.gc.pinned and private packages are
+// never evicted, nor are the stored files of private packages, which live
+// outside of the cache.
+//
+func CollectGarbage(dryRun bool) (*GCReport, error) {
+	report := &GCReport{Started: time.Now().UTC(), DryRun: dryRun}
+	cacheAccess.flush()
+	entries, err := cacheEntries()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].accessed.Before(entries[j].accessed) })
+	for _, e := range entries {
+		report.Entries += 1
+		report.Bytes += e.size
+	}
+
+	maxAge := time.Duration(viper.GetInt64("services.gc.maxAge")) * 24 * time.Hour
+	maxSize := viper.GetInt64("services.gc.maxSize")
+	size := report.Bytes
+	for _, e := range entries {
+		expired := maxAge > 0 && time.Since(e.accessed) > maxAge
+		if !expired && (maxSize <= 0 || size <= maxSize) {
+			continue
+		}
+		if gcExempt(e.file) {
+			report.Exempt += 1
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(e.file); err != nil && !os.IsNotExist(err) {
+				log.Error("Failed evicting cached response ", err)
+				continue
+			}
+		}
+		size -= e.size
+		report.Evicted += 1
+		report.EvictedBytes += e.size
+	}
+	if !dryRun {
+		cacheBytes.Set(size)
+	}
+	report.Finished = time.Now().UTC()
+	log.Infof("GC evicted %d of %d cached response(s), %d bytes", report.Evicted, report.Entries, report.EvictedBytes)
+	return report, nil
+}
+
+// Lists cached responses, removing temporary files left by interrupted writes
+//
+func cacheEntries() ([]cacheEntry, error) {
+	dir := filepath.Join(viper.GetString("services.storage.dir"), "cache")
+	infos, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	for _, info := range infos {
+		file := filepath.Join(dir, info.Name())
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(info.Name(), ".tmp-") {
+			if time.Since(info.ModTime()) > time.Hour {
+				os.Remove(file)
+			}
+			continue
+		}
+		entries = append(entries, cacheEntry{file: file, size: info.Size(), accessed: info.ModTime()})
+	}
+	return entries, nil
+}
+
+// Whether a cached response belongs to a pinned or private package, matching
+// services.gc.pinned entries of author/name or author/name@version.
+//
+func gcExempt(file string) bool {
+	name, version := cachedPackage(file)
+	if name == "" {
+		return false
+	}
+	for _, p := range viper.GetStringSlice("services.gc.pinned") {
+		if strings.EqualFold(p, name) || strings.EqualFold(p, name+"@"+version) {
+			return true
+		}
+	}
+	pkg, err := Packages.GetPackage(name, version)
+	return err == nil && pkg.Private
+}
+
+// Package a cached response belongs to, from the URL stored with it
+//
+func cachedPackage(file string) (string, string) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", ""
+	}
+	defer f.Close()
+	resp, err := http.ReadResponse(bufio.NewReader(f), nil)
+	if err != nil {
+		return "", ""
+	}
+	u, err := url.Parse(resp.Header.Get(cacheUrlHeader))
+	if err != nil {
+		return "", ""
+	}
+	m := packageUrlRe.FindStringSubmatch(u.Path)
+	if m == nil {
+		return "", ""
+	}
+	return m[1], m[2]
+}
+
+// Collects garbage every services.gc.interval seconds when set
+//
+func GCWorker(ctx context.Context) {
+	interval := viper.GetInt64("services.gc.interval")
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			cacheAccess.flush()
+			log.Debug("GCWorker is done.")
+			return
+		case <-ticker.C:
+			if _, err := CollectGarbage(false); err != nil {
+				log.Error("GC failed ", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package elmproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+var semverTag = regexp.MustCompile(`^[0-9]+\.[0-9]+\.[0-9]+$`)
+
+// Repository mapped to a private package, configured under
+// webhooks.incoming.repositories
+//
+type HookRepository struct {
+	Repository string `mapstructure:"repository"`
+	Package    string `mapstructure:"package"`
+	// Optional token used to download archives of private repositories
+	Token string `mapstructure:"token"`
+}
+
+// Tag push received from one of the supported providers
+//
+type TagPush struct {
+	Provider   string
+	Repository string
+	Tag        string
+	ArchiveUrl string
+}
+
+// Subset of the push payload shared by github, gitea and gitlab
+//
+type pushPayload struct {
+	Ref        string `json:"ref"`
+	After      string `json:"after"`
+	Deleted    bool   `json:"deleted"`
+	Repository struct {
+		FullName string `json:"full_name"`
+		HtmlUrl  string `json:"html_url"`
+	} `json:"repository"`
+	Project struct {
+		PathWithNamespace string `json:"path_with_namespace"`
+		Path              string `json:"path"`
+		WebUrl            string `json:"web_url"`
+	} `json:"project"`
+}
+
+func receiveHook(w http.ResponseWriter, r *http.Request) {
+	provider := mux.Vars(r)["provider"]
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, "Invalid payload", 400)
+		return
+	}
+	if !verifyHook(provider, r.Header, b) {
+		log.Warnf("Rejected %s webhook with invalid signature", provider)
+		http.Error(w, "Invalid signature", 401)
+		return
+	}
+	push, err := parseTagPush(provider, b)
+	if err != nil {
+		http.Error(w, "Invalid payload", 400)
+		return
+	}
+	if push == nil {
+		w.WriteHeader(204)
+		return
+	}
+	repo := hookRepository(push.Repository)
+	if repo == nil {
+		log.Debugf("Ignoring tag %s for unmapped repository %s", push.Tag, push.Repository)
+		w.WriteHeader(204)
+		return
+	}
+	// Providers expect a quick response, archives are fetched in the background
+	ip := clientIP(r)
+	go func() {
+		pkg, err := publishTag(push, repo)
+		if err != nil {
+			log.Errorf("Failed publishing %s@%s from %s: %s", repo.Package, push.Tag, push.Repository, err)
+			return
+		}
+		recordAudit(newAuditEntry(AuditPublish, pkg.Publisher, ip, packageSubject(pkg), nil, newEventPackage(pkg)))
+	}()
+	w.WriteHeader(202)
+}
+
+func verifyHook(provider string, h http.Header, body []byte) bool {
+	secret := viper.GetString("webhooks.incoming.secret")
+	if secret == "" {
+		return false
+	}
+	switch provider {
+	case "gitlab":
+		return subtle.ConstantTimeCompare([]byte(h.Get("X-Gitlab-Token")), []byte(secret)) == 1
+	case "gitea":
+		return validMAC(h.Get("X-Gitea-Signature"), secret, body)
+	case "github":
+		return validMAC(strings.TrimPrefix(h.Get("X-Hub-Signature-256"), "sha256="), secret, body)
+	}
+	return false
+}
+
+func validMAC(signature, secret string, body []byte) bool {
+	sig, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// Returns nil when the payload is not the creation of a semver tag
+//
+func parseTagPush(provider string, body []byte) (*TagPush, error) {
+	p := pushPayload{}
+	if err := json.Unmarshal(body, &p); err != nil {
+		return nil, err
+	}
+	// Deleted refs are reported with an all zero commit by gitea and gitlab
+	if p.Deleted || (p.After != "" && strings.Trim(p.After, "0") == "") {
+		return nil, nil
+	}
+	if !strings.HasPrefix(p.Ref, "refs/tags/") {
+		return nil, nil
+	}
+	tag := strings.TrimPrefix(p.Ref, "refs/tags/")
+	if !semverTag.MatchString(tag) {
+		return nil, nil
+	}
+	push := &TagPush{Provider: provider, Tag: tag}
+	switch provider {
+	case "github":
+		push.Repository = p.Repository.FullName
+		push.ArchiveUrl = fmt.Sprintf("%s/zipball/%s/", p.Repository.HtmlUrl, tag)
+	case "gitea":
+		push.Repository = p.Repository.FullName
+		push.ArchiveUrl = fmt.Sprintf("%s/archive/%s.zip", p.Repository.HtmlUrl, tag)
+	case "gitlab":
+		push.Repository = p.Project.PathWithNamespace
+		push.ArchiveUrl = fmt.Sprintf("%s/-/archive/%s/%s-%s.zip", p.Project.WebUrl, tag, p.Project.Path, tag)
+	}
+	return push, nil
+}
+
+func hookRepository(name string) *HookRepository {
+	var repos []HookRepository
+	if err := viper.UnmarshalKey("webhooks.incoming.repositories", &repos); err != nil {
+		log.Error("Invalid webhooks.incoming.repositories ", err)
+		return nil
+	}
+	for _, repo := range repos {
+		if strings.EqualFold(repo.Repository, name) {
+			return &repo
+		}
+	}
+	return nil
+}
+
+func publishTag(push *TagPush, repo *HookRepository) (*Package, error) {
+	req, err := http.NewRequest("GET", push.ArchiveUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	if repo.Token != "" {
+		if push.Provider == "gitlab" {
+			req.Header.Add("PRIVATE-TOKEN", repo.Token)
+		} else {
+			req.Header.Add("Authorization", "token "+repo.Token)
+		}
+	} else if token := viper.GetString("credentials.github"); token != "" && push.Provider == "github" {
+		req.Header.Add("Authorization", "token "+token)
+	}
+	b, err := fetchUpstream(opZipball, req, 0)
+	if err != nil {
+		return nil, err
+	}
+	archive, err := readPackageArchive(b)
+	if err != nil {
+		return nil, err
+	}
+	pkg, err := publishArchive(repo.Package, push.Tag, "webhook:"+push.Repository, archive)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("Received %s@%s from %s", repo.Package, push.Tag, push.Repository)
+	return pkg, nil
+}
@@ -0,0 +1,102 @@
+package elmproxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// Payloads of a 1.2.3 tag push to acme/lib, as sent by each provider
+//
+var tagPushes = map[string]string{
+	"github": `{"ref": "refs/tags/1.2.3", "after": "5f1e2c", "deleted": false,
+		"repository": {"full_name": "acme/lib", "html_url": "https://github.com/acme/lib"}}`,
+	"gitea": `{"ref": "refs/tags/1.2.3", "after": "5f1e2c",
+		"repository": {"full_name": "acme/lib", "html_url": "https://gitea.example.com/acme/lib"}}`,
+	"gitlab": `{"ref": "refs/tags/1.2.3", "after": "5f1e2c",
+		"project": {"path_with_namespace": "acme/lib", "path": "lib", "web_url": "https://gitlab.example.com/acme/lib"}}`,
+}
+
+func signHook(provider, secret string, body []byte) http.Header {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	sig := hex.EncodeToString(mac.Sum(nil))
+	h := http.Header{}
+	switch provider {
+	case "github":
+		h.Set("X-Hub-Signature-256", "sha256="+sig)
+	case "gitea":
+		h.Set("X-Gitea-Signature", sig)
+	case "gitlab":
+		h.Set("X-Gitlab-Token", secret)
+	}
+	return h
+}
+
+func TestVerifyHook(t *testing.T) {
+	viper.Reset()
+	viper.Set("webhooks.incoming.secret", "s3cret")
+	for provider, payload := range tagPushes {
+		body := []byte(payload)
+		if !verifyHook(provider, signHook(provider, "s3cret", body), body) {
+			t.Errorf("%s: rejected a valid signature", provider)
+		}
+		if verifyHook(provider, signHook(provider, "other", body), body) {
+			t.Errorf("%s: accepted a signature made with another secret", provider)
+		}
+		if verifyHook(provider, http.Header{}, body) {
+			t.Errorf("%s: accepted an unsigned payload", provider)
+		}
+		// Gitlab sends the secret itself, leaving the payload unsigned
+		if provider != "gitlab" && verifyHook(provider, signHook(provider, "s3cret", body), append(body, ' ')) {
+			t.Errorf("%s: accepted a modified payload", provider)
+		}
+	}
+	if verifyHook("bitbucket", signHook("github", "s3cret", nil), nil) {
+		t.Error("Accepted a payload from an unsupported provider")
+	}
+
+	viper.Set("webhooks.incoming.secret", "")
+	if verifyHook("gitea", signHook("gitea", "", nil), nil) {
+		t.Error("Accepted a payload without a configured secret")
+	}
+}
+
+func TestParseTagPush(t *testing.T) {
+	archives := map[string]string{
+		"github": "https://github.com/acme/lib/zipball/1.2.3/",
+		"gitea":  "https://gitea.example.com/acme/lib/archive/1.2.3.zip",
+		"gitlab": "https://gitlab.example.com/acme/lib/-/archive/1.2.3/lib-1.2.3.zip",
+	}
+	for provider, payload := range tagPushes {
+		push, err := parseTagPush(provider, []byte(payload))
+		if err != nil {
+			t.Fatalf("%s: %s", provider, err)
+		}
+		want := TagPush{Provider: provider, Repository: "acme/lib", Tag: "1.2.3", ArchiveUrl: archives[provider]}
+		if push == nil || *push != want {
+			t.Errorf("%s: parsed %+v, want %+v", provider, push, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		provider, payload string
+	}{
+		{"github", `{"ref": "refs/tags/1.2.3", "deleted": true, "repository": {"full_name": "acme/lib"}}`},
+		{"gitea", `{"ref": "refs/tags/1.2.3", "after": "0000000000000000000000000000000000000000"}`},
+		{"gitlab", `{"ref": "refs/tags/1.2.3", "after": "0000000000000000000000000000000000000000"}`},
+		{"github", `{"ref": "refs/heads/1.2.3", "after": "5f1e2c"}`},
+		{"gitlab", `{"ref": "refs/tags/v1.2.3", "after": "5f1e2c"}`},
+	} {
+		if push, err := parseTagPush(tc.provider, []byte(tc.payload)); err != nil || push != nil {
+			t.Errorf("%s %s: parsed %+v (%v), want no tag push", tc.provider, tc.payload, push, err)
+		}
+	}
+	if _, err := parseTagPush("gitea", []byte("refs/tags/1.2.3")); err == nil {
+		t.Error("Parsed an invalid payload")
+	}
+}
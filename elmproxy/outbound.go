@@ -0,0 +1,140 @@
+package elmproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	"github.com/spf13/viper"
+)
+
+// Corporate proxy outbound requests are chained through, configured under
+// outbound.proxy. Returns nil when requests should be sent directly.
+//
+func outboundProxyUrl() (*url.URL, error) {
+	raw := viper.GetString("outbound.proxy.url")
+	if raw == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid outbound.proxy.url: %w", err)
+	}
+	if user := viper.GetString("outbound.proxy.username"); user != "" {
+		u.User = url.UserPassword(user, viper.GetString("outbound.proxy.password"))
+	}
+	return u, nil
+}
+
+// Hosts reached directly, matched exactly, by *.domain wildcards or by .domain suffixes
+//
+func bypassOutboundProxy(host string) bool {
+	for _, p := range viper.GetStringSlice("outbound.proxy.noProxy") {
+		if p == "*" {
+			return true
+		}
+		if strings.HasPrefix(p, ".") {
+			p = "*" + p
+		}
+		if matchesHost(host, []string{p, strings.TrimPrefix(p, "*.")}) {
+			return true
+		}
+	}
+	return false
+}
+
+func outboundProxy(r *http.Request) (*url.URL, error) {
+	if bypassOutboundProxy(r.URL.Host) {
+		return nil, nil
+	}
+	return outboundProxyUrl()
+}
+
+// Root CAs trusted for outbound TLS, the system pool with outbound.caFile added,
+// for corporate proxies intercepting TLS.
+//
+func outboundRootCAs() (*x509.CertPool, error) {
+	caFile := viper.GetString("outbound.caFile")
+	if caFile == "" {
+		return nil, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("No certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// Transport used for every outbound request, honoring outbound.proxy,
+// outbound.caFile & services.registry.upstreams
+//
+func OutboundTransport() (*http.Transport, error) {
+	if _, err := outboundProxyUrl(); err != nil {
+		return nil, err
+	}
+	pool, err := outboundRootCAs()
+	if err != nil {
+		return nil, err
+	}
+	dial, err := registryDialer()
+	if err != nil {
+		return nil, err
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.Proxy = outboundProxy
+	t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	t.DialContext = dial
+	return t, nil
+}
+
+// Dialer for tunneled CONNECT requests, chaining them through the outbound proxy
+//
+func OutboundConnectDial(proxy *goproxy.ProxyHttpServer) (func(network, addr string) (net.Conn, error), error) {
+	u, err := outboundProxyUrl()
+	if err != nil || u == nil {
+		return nil, err
+	}
+	var auth string
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth = "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+		u.User = nil
+	}
+	dial := proxy.NewConnectDialToProxyWithHandler(u.String(), func(req *http.Request) {
+		if auth != "" {
+			req.Header.Set("Proxy-Authorization", auth)
+		}
+	})
+	if dial == nil {
+		return nil, fmt.Errorf("Unsupported outbound proxy %s", u.Redacted())
+	}
+	return func(network, addr string) (net.Conn, error) {
+		if bypassOutboundProxy(addr) {
+			return net.Dial(network, addr)
+		}
+		return dial(network, addr)
+	}, nil
+}
+
+func configureOutbound() error {
+	t, err := OutboundTransport()
+	if err != nil {
+		return err
+	}
+	httpClient.Transport = t
+	return nil
+}
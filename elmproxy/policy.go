@@ -0,0 +1,52 @@
+package elmproxy
+
+import (
+	"net"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Hosts intercepted regardless of configuration
+//
+var elmHosts = []string{
+	"package.elm-lang.org",
+	"github.com",
+	"api.github.com",
+}
+
+// Decides how CONNECT requests are handled. Elm related hosts and those under
+// proxy.mitm.hosts are intercepted, every other host is tunneled, or rejected
+// when proxy.unknownHosts is set to reject and it is not under proxy.tunnel.hosts.
+//
+func ConnectPolicy(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+	if matchesHost(host, elmHosts) || matchesHost(host, viper.GetStringSlice("proxy.mitm.hosts")) {
+		return goproxy.MitmConnect, host
+	}
+	if viper.GetString("proxy.unknownHosts") == "reject" && !matchesHost(host, viper.GetStringSlice("proxy.tunnel.hosts")) {
+		log.Debugf("Rejecting CONNECT to %s", host)
+		return goproxy.RejectConnect, host
+	}
+	return goproxy.OkConnect, host
+}
+
+// Matches a host, with or without port, against exact names and *.domain wildcards
+//
+func matchesHost(host string, patterns []string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if p == host {
+			return true
+		}
+		if strings.HasPrefix(p, "*.") && strings.HasSuffix(host, p[1:]) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,123 @@
+package elmproxy
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Package elm.json fields required for validation
+//
+type PackageElmJson struct {
+	Type           string      `json:"type"`
+	Name           string      `json:"name"`
+	Version        string      `json:"version"`
+	ExposedModules interface{} `json:"exposed-modules"`
+}
+
+func (e *PackageElmJson) Validate(name, version string) error {
+	if e.Type != "package" {
+		return errors.New("elm.json type must be package")
+	}
+	if e.Name != name {
+		return fmt.Errorf("elm.json name %s does not match %s", e.Name, name)
+	}
+	if e.Version != version {
+		return fmt.Errorf("elm.json version %s does not match %s", e.Version, version)
+	}
+	if e.ExposedModules == nil {
+		return errors.New("elm.json is missing exposed-modules")
+	}
+	return nil
+}
+
+// Contents of a package archive needed for publishing
+//
+type PackageArchive struct {
+	Zip     []byte
+	ElmJson []byte
+	Readme  []byte
+	Hash    string
+}
+
+// Reads a package zipball as produced by github, gitea or gitlab, where
+// every file is nested within a single top level directory.
+//
+func readPackageArchive(b []byte) (*PackageArchive, error) {
+	zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return nil, err
+	}
+	h := sha1.Sum(b)
+	archive := &PackageArchive{Zip: b, Hash: hex.EncodeToString(h[:])}
+	for _, f := range zr.File {
+		splt := strings.SplitN(f.Name, "/", 2)
+		if len(splt) != 2 {
+			continue
+		}
+		var dst *[]byte
+		switch path.Clean(splt[1]) {
+		case "elm.json":
+			dst = &archive.ElmJson
+		case "README.md":
+			dst = &archive.Readme
+		default:
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		*dst, err = ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	if archive.ElmJson == nil {
+		return nil, errors.New("Archive does not contain an elm.json")
+	}
+	return archive, nil
+}
+
+// Validates an archive and publishes it as a private package. The archive is
+// stored and served at the package's github zipball URL, as provider archive
+// URLs may require credentials and their archives may be generated again
+// with different bytes.
+//
+func publishArchive(name, version, publisher string, archive *PackageArchive) (*Package, error) {
+	ej := PackageElmJson{}
+	if err := json.Unmarshal(archive.ElmJson, &ej); err != nil {
+		return nil, fmt.Errorf("Invalid elm.json: %w", err)
+	}
+	if err := ej.Validate(name, version); err != nil {
+		return nil, err
+	}
+	if _, err := Packages.GetPackage(name, version); err == nil {
+		return nil, errors.New("Package has already been published.")
+	}
+
+	endpoint, err := json.Marshal(Endpoint{Url: getZipballUrl(name, version), Hash: archive.Hash})
+	if err != nil {
+		return nil, err
+	}
+	files := map[string][]byte{
+		"elm.json":         archive.ElmJson,
+		"endpoint.json":    endpoint,
+		packageArchiveFile: archive.Zip,
+	}
+	if archive.Readme != nil {
+		files["README.md"] = archive.Readme
+	}
+	if err := storePackageFiles(name, version, files); err != nil {
+		return nil, err
+	}
+	return addPrivatePackage(name, version, publisher)
+}
@@ -0,0 +1,98 @@
+package elmproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Address the real upstream of a registry host is reached at, for when the
+// host's DNS points at this server. Configured under services.registry.upstreams
+//
+type RegistryUpstream struct {
+	Host    string `mapstructure:"host"`
+	Address string `mapstructure:"address"`
+}
+
+// Serves registry hosts directly, without HTTP CONNECT proxying. Requests to
+// package.elm-lang.org are handled by Router, stored archives are served for
+// github.com, with unhandled paths reverse proxied to the real upstream. Only
+// hosts listed under services.registry.hosts are served, others are misdirected.
+//
+func RegistryHandler() http.Handler {
+	router := Router()
+	upstream := &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "https"
+			r.URL.Host = r.Host
+			if matchesHost(r.Host, []string{"github.com", "api.github.com"}) {
+				if token := viper.GetString("credentials.github"); token != "" {
+					r.Header.Set("Authorization", "token "+token)
+				}
+			}
+		},
+		Transport: StaleCache(registryTransport()),
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("%s - %s%s", r.Method, r.Host, r.URL.Path)
+		if !matchesHost(r.Host, viper.GetStringSlice("services.registry.hosts")) {
+			http.Error(w, "Misdirected Request.", 421)
+			return
+		}
+		if matchesHost(r.Host, []string{"package.elm-lang.org"}) {
+			f := NewWriterFacade()
+			router.ServeHTTP(f, r)
+			if f.edited && f.statusCode != 404 {
+				f.CopyTo(w)
+				return
+			}
+		}
+		if matchesHost(r.Host, []string{"github.com"}) {
+			f := NewWriterFacade()
+			serveArchive(f, r)
+			if f.edited {
+				f.CopyTo(w)
+				return
+			}
+		}
+		upstream.ServeHTTP(w, r)
+	})
+}
+
+// Outbound transport of the reverse proxied hosts
+//
+func registryTransport() *http.Transport {
+	t, err := OutboundTransport()
+	if err != nil {
+		log.Error("Invalid outbound configuration ", err)
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	}
+	return t
+}
+
+// Dials the configured upstream addresses instead of resolving the registry
+// hosts, which may resolve to this server. Used by every outbound transport so
+// syncs, zipball fetches & webhooks don't loop back either.
+//
+func registryDialer() (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	var upstreams []RegistryUpstream
+	if err := viper.UnmarshalKey("services.registry.upstreams", &upstreams); err != nil {
+		return nil, fmt.Errorf("Invalid services.registry.upstreams: %w", err)
+	}
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		for _, u := range upstreams {
+			if matchesHost(addr, []string{u.Host}) {
+				addr = u.Address
+				break
+			}
+		}
+		return dialer.DialContext(ctx, network, addr)
+	}, nil
+}
@@ -0,0 +1,23 @@
+package elmproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestRegistryHandlerRefusesUnlistedHosts(t *testing.T) {
+	viper.Reset()
+	viper.Set("services.registry.hosts", []string{"package.elm-lang.org"})
+	h := RegistryHandler()
+	for _, host := range []string{"10.0.0.5", "localhost:8081", "github.com", "api.github.com"} {
+		rec := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = host
+		h.ServeHTTP(rec, r)
+		if rec.Code != 421 {
+			t.Errorf("%s answered %d, want 421", host, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package elmproxy
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Archive stored along with a package version, when kept
+//
+const packageArchiveFile = "package.zip"
+
+// Manifests without a package and unreferenced blobs are only reported once
+// they're this old, as publishing stores files before adding the package.
+//
+const orphanGrace = time.Hour
+
+// Problems found by the latest scrub
+//
+var scrubIssues = expvar.NewInt("scrub_issues")
+
+// Problem found with the stored files of a package version
+//
+type ScrubIssue struct {
+	Package string `json:"package,omitempty"`
+	File    string `json:"file,omitempty"`
+	Problem string `json:"problem"`
+	// Set when repair fixed the problem
+	Repaired bool `json:"repaired"`
+}
+
+type ScrubReport struct {
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	Repair   bool         `json:"repair"`
+	Checked  int          `json:"checked"`
+	Issues   []ScrubIssue `json:"issues"`
+}
+
+// Issues left unrepaired
+//
+func (r *ScrubReport) Unresolved() int {
+	n := 0
+	for _, i := range r.Issues {
+		if !i.Repaired {
+			n += 1
+		}
+	}
+	return n
+}
+
+var (
+	// Serializes scrubs
+	scrubMu sync.Mutex
+	// Guards lastScrub, readable while a scrub runs
+	scrubbedMu sync.Mutex
+	lastScrub  *ScrubReport
+)
+
+// Verifies the stored files of every private or imported package, and reports
+// stored files without a package. See scrubPackage & scrubOrphans for repairs.
+//
+func Scrub(repair bool) (*ScrubReport, error) {
+	scrubMu.Lock()
+	defer scrubMu.Unlock()
+	report := &ScrubReport{Started: time.Now().UTC(), Repair: repair, Issues: []ScrubIssue{}}
+	pkgs, err := Packages.GetStoredPackages()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(pkgs))
+	for i := range pkgs {
+		pkg := &pkgs[i]
+		known[packageSubject(pkg)] = true
+		report.Checked += 1
+		report.Issues = append(report.Issues, scrubPackage(pkg, repair)...)
+	}
+	orphans, err := scrubOrphans(known, repair)
+	if err != nil {
+		return nil, err
+	}
+	report.Issues = append(report.Issues, orphans...)
+	report.Finished = time.Now().UTC()
+
+	scrubIssues.Set(int64(report.Unresolved()))
+	scrubbedMu.Lock()
+	lastScrub = report
+	scrubbedMu.Unlock()
+	if n := report.Unresolved(); n > 0 {
+		log.Warnf("Scrub found %d unresolved issue(s) in %d package(s)", n, report.Checked)
+	}
+	return report, nil
+}
+
+// Files every stored package version must have
+//
+var requiredPackageFiles = []string{"elm.json", "endpoint.json"}
+
+// Verifies the blobs of a package version, checking elm.json & endpoint.json.
+// Packages imported from other proxies are fetched on demand, so missing files
+// are expected, and repair drops their invalid files from the manifest.
+//
+func scrubPackage(pkg *Package, repair bool) []ScrubIssue {
+	subject := packageSubject(pkg)
+	imported := pkg.OriginID != 0
+	m, err := readManifest(pkg.Name, pkg.Version)
+	if os.IsNotExist(err) {
+		m, err = &Manifest{Files: make(map[string]string)}, nil
+	}
+	if err != nil {
+		return []ScrubIssue{{Package: subject, Problem: err.Error()}}
+	}
+	var issues []ScrubIssue
+	var broken []string
+	for _, file := range sortedFiles(m) {
+		b, err := readBlob(m.Files[file])
+		if err == nil {
+			switch file {
+			case "elm.json":
+				err = checkElmJson(pkg, b)
+			case "endpoint.json":
+				err = checkEndpoint(m, b)
+			}
+		}
+		if err != nil {
+			issues = append(issues, ScrubIssue{Package: subject, File: file, Problem: err.Error()})
+			broken = append(broken, file)
+		}
+	}
+	if !imported {
+		for _, file := range requiredPackageFiles {
+			if _, ok := m.Files[file]; !ok {
+				issues = append(issues, ScrubIssue{Package: subject, File: file, Problem: "missing"})
+			}
+		}
+	}
+	if repair && imported && len(broken) > 0 {
+		manifestMu.Lock()
+		for _, file := range broken {
+			delete(m.Files, file)
+		}
+		err := writeManifest(pkg.Name, pkg.Version, m)
+		manifestMu.Unlock()
+		if err != nil {
+			log.Errorf("Failed repairing %s: %s", subject, err)
+			return issues
+		}
+		for i := range issues {
+			issues[i].Repaired = true
+		}
+	}
+	return issues
+}
+
+func sortedFiles(m *Manifest) []string {
+	files := make([]string, 0, len(m.Files))
+	for file := range m.Files {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files
+}
+
+func checkElmJson(pkg *Package, b []byte) error {
+	ej := PackageElmJson{}
+	if err := json.Unmarshal(b, &ej); err != nil {
+		return fmt.Errorf("invalid: %w", err)
+	}
+	return ej.Validate(pkg.Name, pkg.Version)
+}
+
+func checkEndpoint(m *Manifest, b []byte) error {
+	var e Endpoint
+	if err := json.Unmarshal(b, &e); err != nil {
+		return fmt.Errorf("invalid: %w", err)
+	}
+	if e.Url == "" || e.Hash == "" {
+		return fmt.Errorf("missing url or hash")
+	}
+	digest, ok := m.Files[packageArchiveFile]
+	if !ok {
+		return nil
+	}
+	archive, err := readBlob(digest)
+	if err != nil {
+		return err
+	}
+	h := sha1.Sum(archive)
+	if sum := hex.EncodeToString(h[:]); sum != e.Hash {
+		return fmt.Errorf("hash %s does not match stored archive %s", e.Hash, sum)
+	}
+	return nil
+}
+
+// Reports manifests without a package, and blobs no manifest references.
+// Repair moves orphaned manifests under orphans in the storage directory and
+// removes unreferenced blobs.
+//
+func scrubOrphans(known map[string]bool, repair bool) ([]ScrubIssue, error) {
+	storage := viper.GetString("services.storage.dir")
+	manifests, err := filepath.Glob(filepath.Join(storage, "manifests", "*", "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var issues []ScrubIssue
+	for _, path := range manifests {
+		rel, _ := filepath.Rel(filepath.Join(storage, "manifests"), path)
+		subject := strings.TrimSuffix(filepath.ToSlash(filepath.Dir(rel))+"@"+filepath.Base(rel), ".json")
+		info, err := os.Stat(path)
+		if err != nil || known[subject] || time.Since(info.ModTime()) < orphanGrace {
+			continue
+		}
+		issue := ScrubIssue{Package: subject, Problem: "orphaned manifest"}
+		if repair {
+			dst := filepath.Join(storage, "orphans", "manifests", rel)
+			if err := os.MkdirAll(filepath.Dir(dst), 0777); err == nil {
+				err = os.Rename(path, dst)
+			}
+			if err != nil {
+				log.Errorf("Failed moving orphaned %s: %s", path, err)
+			} else {
+				issue.Repaired = true
+			}
+		}
+		issues = append(issues, issue)
+	}
+
+	// Orphaned manifests keep their blobs, so they can be restored. Stores may
+	// reference an existing blob at any time, so none are removed until the
+	// referenced set is complete.
+	if repair {
+		manifestMu.Lock()
+		defer manifestMu.Unlock()
+	}
+	referenced := make(map[string]bool)
+	for _, pattern := range []string{
+		filepath.Join(storage, "manifests", "*", "*", "*.json"),
+		filepath.Join(storage, "orphans", "manifests", "*", "*", "*.json"),
+	} {
+		paths, _ := filepath.Glob(pattern)
+		for _, path := range paths {
+			m, err := readManifestFile(path)
+			if err != nil {
+				// Blobs of unreadable manifests can't be told apart
+				return issues, nil
+			}
+			for _, digest := range m.Files {
+				referenced[digest] = true
+			}
+		}
+	}
+	blobs, err := filepath.Glob(filepath.Join(storage, "blobs", "sha256", "*", "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range blobs {
+		info, err := os.Stat(path)
+		if err != nil || referenced[filepath.Base(path)] || strings.HasPrefix(filepath.Base(path), ".tmp-") ||
+			time.Since(info.ModTime()) < orphanGrace {
+			continue
+		}
+		rel, _ := filepath.Rel(storage, path)
+		issue := ScrubIssue{File: filepath.ToSlash(rel), Problem: "unreferenced blob"}
+		if repair {
+			if err := os.Remove(path); err != nil {
+				log.Errorf("Failed removing %s: %s", path, err)
+			} else {
+				issue.Repaired = true
+			}
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
+
+// Scrubs every services.integrity.scrubInterval seconds when set, repairing
+// when services.integrity.repair is set.
+//
+func ScrubWorker(ctx context.Context) {
+	interval := viper.GetInt64("services.integrity.scrubInterval")
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug("ScrubWorker is done.")
+			return
+		case <-ticker.C:
+			if _, err := Scrub(viper.GetBool("services.integrity.repair")); err != nil {
+				log.Error("Scrub failed ", err)
+			}
+		}
+	}
+}
+
+// Latest scrub report, 404 before the first scrub
+//
+func getScrubReport(w http.ResponseWriter, r *http.Request) {
+	scrubbedMu.Lock()
+	report := lastScrub
+	scrubbedMu.Unlock()
+	if report == nil {
+		http.Error(w, "No scrub has run yet.", 404)
+		return
+	}
+	writeJson(w, report)
+}
+
+// Scrubs right away, repairing with repair=true
+//
+func triggerScrub(w http.ResponseWriter, r *http.Request) {
+	repair := r.URL.Query().Get("repair") == "true"
+	report, err := Scrub(repair)
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	log.Infof("%s triggered a scrub, repair: %t", requestActor(r), repair)
+	if repair {
+		audit(r, AuditScrubRepair, "storage", nil, report.Issues)
+	}
+	writeJson(w, report)
+}
@@ -0,0 +1,136 @@
+package elmproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Immutable view of the published registry, serving /all-packages and
+// /all-packages/since/N without touching the database.
+//
+type registrySnapshot struct {
+	// Highest package ID included
+	version uint64
+	// Published versions ordered by package ID
+	versions []string
+	identity []byte
+	gzipped  []byte
+	etag     string
+}
+
+var (
+	snapshot atomic.Value
+	// Serializes snapshot updates
+	snapshotMu sync.Mutex
+	// Package listings by name, only touched while holding snapshotMu
+	snapshotNames map[string][]string
+)
+
+// Returns the current snapshot, building it on first use
+//
+func currentSnapshot() (*registrySnapshot, error) {
+	if s, ok := snapshot.Load().(*registrySnapshot); ok {
+		return s, nil
+	}
+	if err := updateSnapshot(false); err != nil {
+		return nil, err
+	}
+	return snapshot.Load().(*registrySnapshot), nil
+}
+
+// Appends packages published since the current snapshot, or rebuilds it
+// entirely after removals.
+//
+func updateSnapshot(rebuild bool) error {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+	current, _ := snapshot.Load().(*registrySnapshot)
+	next := &registrySnapshot{}
+	var pkgs []Package
+	var err error
+	if current == nil || rebuild {
+		snapshotNames = make(map[string][]string)
+		pkgs, err = Packages.GetAllPackages()
+		sort.Slice(pkgs, func(i, j int) bool { return pkgs[i].ID < pkgs[j].ID })
+	} else {
+		pkgs, err = Packages.GetPackagesSince(current.version)
+		if err == nil && len(pkgs) == 0 {
+			return nil
+		}
+		// Readers only look within their own lengths, so appending is safe
+		next.versions = current.versions
+		next.version = current.version
+	}
+	if err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		snapshotNames[pkg.Name] = append(snapshotNames[pkg.Name], pkg.Version)
+		next.versions = append(next.versions, packageSubject(&pkg))
+		if uint64(pkg.ID) > next.version {
+			next.version = uint64(pkg.ID)
+		}
+	}
+	if err := next.serialize(); err != nil {
+		return err
+	}
+	snapshot.Store(next)
+	return nil
+}
+
+func (s *registrySnapshot) serialize() error {
+	b, err := json.Marshal(snapshotNames)
+	if err != nil {
+		return err
+	}
+	var gz bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&gz, gzip.BestCompression)
+	if _, err := zw.Write(b); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	h := sha256.Sum256(b)
+	s.identity = b
+	s.gzipped = gz.Bytes()
+	s.etag = `"` + hex.EncodeToString(h[:16]) + `"`
+	return nil
+}
+
+// Versions listed after the first n. The compiler asks for versions since the
+// number it knows, so the listing is dense regardless of gaps between package
+// IDs, which skipped, pending & approved versions leave. Clients that knew a
+// version removed since are ahead by one, as the protocol can't express removals.
+//
+func (s *registrySnapshot) since(n uint64) []string {
+	if n >= uint64(len(s.versions)) {
+		return []string{}
+	}
+	out := make([]string, uint64(len(s.versions))-n)
+	copy(out, s.versions[n:])
+	return out
+}
+
+// Keeps the snapshot current as packages are published & removed
+//
+func snapshotListener(e Event) {
+	var err error
+	switch e.Type {
+	case EventPublished, EventSynced:
+		err = updateSnapshot(false)
+	case EventYanked, EventDeleted:
+		err = updateSnapshot(true)
+	}
+	if err != nil {
+		log.Error("Failed updating registry snapshot ", err)
+	}
+}
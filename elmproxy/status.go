@@ -0,0 +1,151 @@
+package elmproxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Progress of the sync worker, readable while a sync is running
+//
+type syncStatus struct {
+	mu          sync.Mutex
+	syncing     bool
+	lastAttempt time.Time
+	lastSuccess time.Time
+	lastError   string
+	failures    int
+	nextRun     time.Time
+}
+
+var status = &syncStatus{}
+
+func (s *syncStatus) started() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncing = true
+	s.lastAttempt = time.Now().UTC()
+}
+
+func (s *syncStatus) finished(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncing = false
+	if err != nil {
+		s.lastError = err.Error()
+		s.failures += 1
+		return
+	}
+	s.lastSuccess = s.lastAttempt
+	s.lastError = ""
+	s.failures = 0
+}
+
+func (s *syncStatus) consecutiveFailures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+func (s *syncStatus) scheduled(next time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextRun = next.UTC()
+}
+
+type SyncReport struct {
+	// Set while the latest sync failed, listings may be missing recent versions
+	Degraded    bool       `json:"degraded"`
+	Syncing     bool       `json:"syncing"`
+	LastAttempt *time.Time `json:"lastAttempt"`
+	LastSuccess *time.Time `json:"lastSuccess"`
+	LastError   string     `json:"lastError,omitempty"`
+	// Consecutive failed syncs
+	Failures int        `json:"failures"`
+	NextRun  *time.Time `json:"nextRun"`
+	Interval int64      `json:"interval"`
+	// Published versions currently listed
+	Packages  int         `json:"packages"`
+	Upstreams []SyncState `json:"upstreams"`
+	// Set by POST /admin/sync, false when skipped as recently synced
+	Synced *bool `json:"synced,omitempty"`
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func syncReport() (*SyncReport, error) {
+	states, err := Packages.GetSyncStates()
+	if err != nil {
+		return nil, err
+	}
+	status.mu.Lock()
+	report := &SyncReport{
+		Degraded:    status.failures > 0,
+		Syncing:     status.syncing,
+		LastAttempt: optionalTime(status.lastAttempt),
+		LastSuccess: optionalTime(status.lastSuccess),
+		LastError:   status.lastError,
+		Failures:    status.failures,
+		NextRun:     optionalTime(status.nextRun),
+		Interval:    viper.GetInt64("services.sync.interval"),
+		Upstreams:   states,
+	}
+	status.mu.Unlock()
+	if snap, err := currentSnapshot(); err == nil {
+		report.Packages = len(snap.versions)
+	}
+	return report, nil
+}
+
+func getSyncStatus(w http.ResponseWriter, r *http.Request) {
+	report, err := syncReport()
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	writeJson(w, report)
+}
+
+// Syncs right away, skipped when recently synced unless force=true
+//
+func triggerSync(w http.ResponseWriter, r *http.Request) {
+	synced, syncErr := syncPackages(r.URL.Query().Get("force") == "true")
+	log.Infof("%s triggered a sync, synced: %t", requestActor(r), synced)
+	report, err := syncReport()
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	report.Synced = &synced
+	if syncErr != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(502)
+	}
+	writeJson(w, report)
+}
+
+// Reports whether the proxy is serving current data, or degraded by failing syncs
+//
+func health(w http.ResponseWriter, r *http.Request) {
+	status.mu.Lock()
+	h := struct {
+		Status      string     `json:"status"`
+		LastSuccess *time.Time `json:"lastSuccess"`
+		LastError   string     `json:"lastError,omitempty"`
+	}{"ok", optionalTime(status.lastSuccess), status.lastError}
+	if status.failures > 0 {
+		h.Status = "degraded"
+	}
+	status.mu.Unlock()
+	writeJson(w, h)
+}
@@ -0,0 +1,199 @@
+package elmproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// Package files are stored as blobs named by the SHA-256 of their content,
+// deduplicating identical files across versions, with a manifest per version
+// mapping file names to blobs.
+//
+type Manifest struct {
+	Files map[string]string `json:"files"`
+}
+
+// Serializes manifest updates
+//
+var manifestMu sync.Mutex
+
+func blobPath(digest string) string {
+	return filepath.Join(viper.GetString("services.storage.dir"), "blobs", "sha256", digest[:2], digest)
+}
+
+func manifestPath(name, version string) string {
+	return filepath.Join(viper.GetString("services.storage.dir"), "manifests", name, version+".json")
+}
+
+func digestOf(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func putBlob(b []byte) (string, error) {
+	digest := digestOf(b)
+	p := blobPath(digest)
+	if _, err := os.Stat(p); err == nil {
+		return digest, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return "", err
+	}
+	return digest, writeFileAtomic(p, func(w io.Writer) error {
+		_, err := w.Write(b)
+		return err
+	})
+}
+
+// Reads a blob, failing when its content no longer matches its digest
+//
+func readBlob(digest string) ([]byte, error) {
+	if len(digest) != sha256.Size*2 {
+		return nil, fmt.Errorf("Invalid digest %s", digest)
+	}
+	b, err := ioutil.ReadFile(blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	if sum := digestOf(b); sum != digest {
+		return nil, fmt.Errorf("Blob %s is corrupt, its content hashes to %s", digest, sum)
+	}
+	return b, nil
+}
+
+func readManifest(name, version string) (*Manifest, error) {
+	return readManifestFile(manifestPath(name, version))
+}
+
+func readManifestFile(path string) (*Manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("Invalid manifest %s: %w", path, err)
+	}
+	if m.Files == nil {
+		m.Files = make(map[string]string)
+	}
+	return m, nil
+}
+
+func writeManifest(name, version string, m *Manifest) error {
+	p := manifestPath(name, version)
+	if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(m)
+	})
+}
+
+// Stores files of a package version, in addition to those already stored
+//
+func storePackageFiles(name, version string, files map[string][]byte) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	m, err := readManifest(name, version)
+	if os.IsNotExist(err) {
+		m, err = &Manifest{Files: make(map[string]string)}, nil
+	}
+	if err != nil {
+		return err
+	}
+	for file, b := range files {
+		digest, err := putBlob(b)
+		if err != nil {
+			return err
+		}
+		m.Files[file] = digest
+	}
+	return writeManifest(name, version, m)
+}
+
+// Reads a stored file of a package version along with its digest, returning
+// an os.ErrNotExist error when it isn't stored.
+//
+func readPackageFile(name, version, file string) ([]byte, string, error) {
+	m, err := readManifest(name, version)
+	if err != nil {
+		return nil, "", err
+	}
+	digest, ok := m.Files[file]
+	if !ok {
+		return nil, "", os.ErrNotExist
+	}
+	b, err := readBlob(digest)
+	return b, digest, err
+}
+
+// Removes the manifest of a package version, its blobs are left to scrubs
+// as other versions may share them.
+//
+func removePackageFiles(name, version string) error {
+	manifestMu.Lock()
+	defer manifestMu.Unlock()
+	if err := os.Remove(manifestPath(name, version)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Moves package files stored as packages/{author}/{name}/{version}/{file}
+// into the blob store.
+//
+func migrateStorage() error {
+	root := filepath.Join(viper.GetString("services.storage.dir"), "packages")
+	dirs, err := filepath.Glob(filepath.Join(root, "*", "*", "*"))
+	if err != nil {
+		return err
+	}
+	migrated := 0
+	for _, dir := range dirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		files := make(map[string][]byte)
+		for _, info := range infos {
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			if files[info.Name()], err = ioutil.ReadFile(filepath.Join(dir, info.Name())); err != nil {
+				return err
+			}
+		}
+		rel, _ := filepath.Rel(root, dir)
+		rel = filepath.ToSlash(rel)
+		if err := storePackageFiles(filepath.ToSlash(filepath.Dir(rel)), filepath.Base(rel), files); err != nil {
+			return err
+		}
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+		migrated += 1
+	}
+	if migrated > 0 {
+		log.Infof("Migrated %d package version(s) to the blob store", migrated)
+	}
+	// Only succeeds for the directories left empty
+	for _, pattern := range []string{"*/*", "*"} {
+		parents, _ := filepath.Glob(filepath.Join(root, pattern))
+		for _, p := range parents {
+			os.Remove(p)
+		}
+	}
+	os.Remove(root)
+	return nil
+}
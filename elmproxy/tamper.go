@@ -0,0 +1,220 @@
+package elmproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Public package files pinned when first seen, as published packages never change
+//
+var pinnedPathRe = regexp.MustCompile(`^/packages/([^/]+/[^/]+)/([^/]+)/(elm\.json|endpoint\.json)$`)
+
+// Number of times upstream content differed from the pinned copy
+//
+var tamperDetections = expvar.NewInt("tamper_detections")
+
+// Hash of a public package file when first received from upstream, which
+// every later copy must match.
+//
+type PinnedFile struct {
+	ID      uint   `gorm:"primarykey" json:"-"`
+	Name    string `gorm:"uniqueIndex:idx_pinned_file" json:"name"`
+	Version string `gorm:"uniqueIndex:idx_pinned_file" json:"version"`
+	File    string `gorm:"uniqueIndex:idx_pinned_file" json:"file"`
+	// SHA-256 of the content
+	Hash string `json:"hash"`
+	// Archive hash referenced by endpoint.json
+	ZipballHash string    `json:"zipballHash,omitempty"`
+	Content     []byte    `json:"-"`
+	FirstSeen   time.Time `json:"firstSeen"`
+	LastChecked time.Time `json:"lastChecked"`
+	// Latest differing content received from upstream
+	TamperedHash        string     `json:"tamperedHash,omitempty"`
+	TamperedZipballHash string     `json:"tamperedZipballHash,omitempty"`
+	TamperedAt          *time.Time `json:"tamperedAt,omitempty"`
+	Mismatches          int        `json:"mismatches"`
+}
+
+func zipballHash(file string, b []byte) string {
+	var e Endpoint
+	if file != "endpoint.json" || json.Unmarshal(b, &e) != nil {
+		return ""
+	}
+	return e.Hash
+}
+
+// Compares content received from upstream with the pinned copy, pinning it
+// when first seen. Returns the pinned content and whether upstream differed.
+//
+func verifyPinned(name, version, file string, b []byte) ([]byte, bool, error) {
+	h := sha256.Sum256(b)
+	sum := hex.EncodeToString(h[:])
+	now := time.Now().UTC()
+	pin, err := Packages.GetPinnedFile(name, version, file)
+	if err == gorm.ErrRecordNotFound {
+		pin = &PinnedFile{
+			Name:        name,
+			Version:     version,
+			File:        file,
+			Hash:        sum,
+			ZipballHash: zipballHash(file, b),
+			Content:     b,
+			FirstSeen:   now,
+			LastChecked: now,
+		}
+		return b, false, Packages.PinFile(pin)
+	} else if err != nil {
+		return nil, false, err
+	}
+	pin.LastChecked = now
+	tampered := pin.Hash != sum
+	if tampered {
+		pin.Mismatches += 1
+		tamperDetections.Add(1)
+		// Alerts once for every new content
+		if pin.TamperedHash != sum {
+			pin.TamperedHash = sum
+			pin.TamperedZipballHash = zipballHash(file, b)
+			pin.TamperedAt = &now
+			log.Errorf("Upstream %s of %s@%s changed from %s to %s, serving the pinned copy", file, name, version, pin.Hash, sum)
+			emit(EventTampered, tamperedPackage(name, version))
+		}
+	}
+	return pin.Content, tampered, Packages.SavePinnedFile(pin)
+}
+
+func tamperedPackage(name, version string) *Package {
+	if pkg, err := Packages.GetPackage(name, version); err == nil {
+		return pkg
+	}
+	return &Package{Name: name, Version: version}
+}
+
+// Transport pinning public package files, replacing upstream responses that
+// differ from the pinned copy.
+//
+type pinningTransport struct {
+	next http.RoundTripper
+}
+
+func (t *pinningTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	m := pinnedPathRe.FindStringSubmatch(req.URL.Path)
+	if m == nil || req.Method != "GET" || !matchesHost(req.URL.Host, []string{"package.elm-lang.org"}) {
+		return t.next.RoundTrip(req)
+	}
+	// Compared decoded, letting the transport handle compression
+	req = req.Clone(req.Context())
+	req.Header.Del("Accept-Encoding")
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != 200 {
+		return resp, err
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	pinned, tampered, err := verifyPinned(m[1], m[2], m[3], b)
+	if err != nil {
+		log.Error("Failed verifying pinned file ", err)
+		pinned = b
+	}
+	if tampered {
+		resp.Header.Set("Warning", `199 - "Upstream content changed, serving pinned copy"`)
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(pinned))
+	resp.ContentLength = int64(len(pinned))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(pinned)))
+	return resp, nil
+}
+
+// Periodically fetches every pinned file again, every
+// services.integrity.recheckInterval seconds when set.
+//
+func RecheckWorker(ctx context.Context) {
+	interval := viper.GetInt64("services.integrity.recheckInterval")
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(time.Second * time.Duration(interval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug("RecheckWorker is done.")
+			return
+		case <-ticker.C:
+			if err := recheckPinned(ctx); err != nil {
+				log.Error("Failed rechecking pinned files ", err)
+			}
+		}
+	}
+}
+
+func recheckPinned(ctx context.Context) error {
+	us, err := upstreams()
+	if err != nil {
+		return err
+	}
+	var after uint
+	for ctx.Err() == nil {
+		pins, err := Packages.GetPinnedFiles(after, 100)
+		if err != nil || len(pins) == 0 {
+			return err
+		}
+		for _, pin := range pins {
+			after = pin.ID
+			b, err := fetchPinned(us, &pin)
+			if err != nil {
+				log.Warnf("Failed rechecking %s of %s@%s: %s", pin.File, pin.Name, pin.Version, err)
+				continue
+			}
+			if _, _, err := verifyPinned(pin.Name, pin.Version, pin.File, b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Fetches a pinned file from the first registry upstream serving it
+//
+func fetchPinned(us []Upstream, pin *PinnedFile) ([]byte, error) {
+	err := fmt.Errorf("No registry upstream configured")
+	for _, u := range us {
+		if u.isProxy() {
+			continue
+		}
+		var b []byte
+		if b, err = u.fetch(opSync, fmt.Sprintf("/packages/%s/%s/%s", pin.Name, pin.Version, pin.File)); err == nil {
+			return b, nil
+		}
+	}
+	return nil, err
+}
+
+// Lists pinned files whose upstream content changed
+//
+func tamperedFiles(w http.ResponseWriter, r *http.Request) {
+	pins, err := Packages.GetTamperedFiles()
+	if err != nil {
+		log.Error(err.Error())
+		http.Error(w, "Server Error.", 500)
+		return
+	}
+	writeJson(w, pins)
+}
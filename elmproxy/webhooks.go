@@ -0,0 +1,187 @@
+package elmproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gorm.io/gorm"
+)
+
+// Destination of outgoing webhooks, configured under webhooks.outgoing.targets
+//
+type WebhookTarget struct {
+	Url    string `mapstructure:"url"`
+	Secret string `mapstructure:"secret"`
+	// Event types sent to the target, all events when empty
+	Events []string `mapstructure:"events"`
+}
+
+func (t *WebhookTarget) Accepts(e EventType) bool {
+	if len(t.Events) == 0 {
+		return true
+	}
+	for _, ev := range t.Events {
+		if ev == string(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// Persisted webhook delivery, retried until delivered or out of attempts
+//
+type WebhookDelivery struct {
+	gorm.Model
+	Url         string
+	Event       string
+	Payload     string
+	Attempts    int
+	NextAttempt time.Time `gorm:"index"`
+	LastError   string
+	Delivered   bool
+	Failed      bool
+}
+
+var deliveryQueued = make(chan struct{}, 1)
+
+func webhookTargets() []WebhookTarget {
+	var targets []WebhookTarget
+	if err := viper.UnmarshalKey("webhooks.outgoing.targets", &targets); err != nil {
+		log.Error("Invalid webhooks.outgoing.targets ", err)
+		return nil
+	}
+	return targets
+}
+
+// Event listener queueing a delivery for every interested target
+//
+func queueWebhooks(e Event) {
+	var deliveries []WebhookDelivery
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	for _, t := range webhookTargets() {
+		if !t.Accepts(e.Type) {
+			continue
+		}
+		deliveries = append(deliveries, WebhookDelivery{
+			Url:         t.Url,
+			Event:       string(e.Type),
+			Payload:     string(payload),
+			NextAttempt: e.Time,
+		})
+	}
+	if len(deliveries) == 0 {
+		return
+	}
+	if err := Packages.QueueDeliveries(deliveries); err != nil {
+		log.Error("Failed queueing webhooks ", err)
+		return
+	}
+	select {
+	case deliveryQueued <- struct{}{}:
+	default:
+	}
+}
+
+// Delivers queued webhooks as they are queued or become due for a retry
+//
+func WebhookWorker(ctx context.Context) {
+	ticker := time.NewTicker(time.Second * 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			log.Debug("WebhookWorker is done.")
+			return
+		case <-ticker.C:
+		case <-deliveryQueued:
+		}
+		deliveries, err := Packages.GetDueDeliveries(time.Now().UTC())
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		for i := range deliveries {
+			deliverWebhook(&deliveries[i])
+		}
+	}
+}
+
+func deliverWebhook(d *WebhookDelivery) {
+	var target *WebhookTarget
+	for _, t := range webhookTargets() {
+		if t.Url == d.Url {
+			target = &t
+			break
+		}
+	}
+	d.Attempts += 1
+	if target == nil {
+		d.Failed = true
+		d.LastError = "Target is no longer configured"
+	} else if err := sendWebhook(target, d); err != nil {
+		d.LastError = err.Error()
+		if d.Attempts >= viper.GetInt("webhooks.outgoing.retries") {
+			log.Errorf("Giving up on webhook %d to %s: %s", d.ID, d.Url, err)
+			d.Failed = true
+		} else {
+			d.NextAttempt = time.Now().UTC().Add(webhookBackoff(d.Attempts))
+		}
+	} else {
+		d.Delivered = true
+		d.LastError = ""
+	}
+	if err := Packages.UpdateDelivery(d); err != nil {
+		log.Error(err)
+	}
+}
+
+func sendWebhook(t *WebhookTarget, d *WebhookDelivery) error {
+	req, err := http.NewRequest("POST", t.Url, bytes.NewReader([]byte(d.Payload)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Elm-Proxy-Event", d.Event)
+	req.Header.Set("X-Elm-Proxy-Delivery", strconv.FormatUint(uint64(d.ID), 10))
+	if t.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(t.Secret))
+		mac.Write([]byte(d.Payload))
+		req.Header.Set("X-Elm-Proxy-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Target responded with %s", resp.Status)
+	}
+	return nil
+}
+
+// Exponential backoff starting at 10 seconds, capped at an hour
+//
+func webhookBackoff(attempts int) time.Duration {
+	d := time.Second * 10
+	for i := 1; i < attempts && d < time.Hour; i++ {
+		d *= 2
+	}
+	if d > time.Hour {
+		d = time.Hour
+	}
+	return d
+}
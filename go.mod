@@ -4,6 +4,7 @@ go 1.15
 
 require (
 	github.com/elazarl/goproxy v0.0.0-20210110162100-a92cc753f88e
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/gorilla/mux v1.8.0
 	github.com/mattn/go-sqlite3 v1.14.7 // indirect
 	github.com/sirupsen/logrus v1.8.1
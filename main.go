@@ -4,11 +4,16 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"regexp"
 	"syscall"
 	"time"
@@ -23,68 +28,361 @@ import (
 
 func main() {
 	configFilePath := flag.String("config", "./config.yml", "Config file")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags] [command]\n\nCommands:\n", os.Args[0])
+		fmt.Fprintln(flag.CommandLine.Output(), "  serve      Run the proxy & API servers (default)")
+		fmt.Fprintln(flag.CommandLine.Output(), "  init-ca    Generate the CA certificate & key")
+		fmt.Fprintln(flag.CommandLine.Output(), "  reconcile  Repair differences between the upstream registry & database")
+		fmt.Fprintln(flag.CommandLine.Output(), "  verify     Check stored package files against the database, -repair fixes what it can")
+		fmt.Fprintln(flag.CommandLine.Output(), "  gc         Evict cached responses past the retention policy, -dry-run only reports")
+		fmt.Fprintln(flag.CommandLine.Output(), "  backup     Archive the database, storage, config & CA, -since N for packages after N")
+		fmt.Fprintln(flag.CommandLine.Output(), "  restore    Restore a backup archive into a new instance, or merge an incremental one")
+		fmt.Fprintln(flag.CommandLine.Output(), "  export     Bundle packages for offline proxies, from -elm-json app/elm.json or author/name@version args")
+		fmt.Fprintln(flag.CommandLine.Output(), "  import     Import a bundle, verifying every hash")
+		fmt.Fprintln(flag.CommandLine.Output(), "  import-elm-home  Import the packages cached in an ELM_HOME directory, -offline skips the registry")
+		fmt.Fprintln(flag.CommandLine.Output(), "\nFlags:")
+		flag.PrintDefaults()
+	}
 	flag.Parse()
+	// Restoring may provide the config
+	if flag.Arg(0) == "restore" {
+		restore(*configFilePath, flag.Args()[1:])
+		return
+	}
+	loadConfig(*configFilePath)
 
+	switch flag.Arg(0) {
+	case "", "serve":
+		serve()
+	case "init-ca":
+		initCA(flag.Args()[1:])
+	case "reconcile":
+		reconcile()
+	case "verify":
+		verify(flag.Args()[1:])
+	case "gc":
+		collectGarbage(flag.Args()[1:])
+	case "backup":
+		backup(flag.Args()[1:])
+	case "export":
+		exportBundle(flag.Args()[1:])
+	case "import":
+		importBundle(flag.Args()[1:])
+	case "import-elm-home":
+		importElmHome(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+func loadConfig(path string) {
 	viper.SetDefault("services.proxy", "localhost:8080")
 	viper.SetDefault("services.api", "localhost:8081")
 	viper.SetDefault("global.logLevel", "INFO")
 	viper.SetDefault("services.sync.interval", 600)
+	viper.SetDefault("services.sync.reconcileInterval", 0)
+	viper.SetDefault("services.sync.retryDelay", 5)
+	viper.SetDefault("services.integrity.recheckInterval", 0)
+	viper.SetDefault("services.integrity.scrubInterval", 0)
+	viper.SetDefault("services.integrity.repair", false)
+	viper.SetDefault("services.gc.interval", 0)
+	viper.SetDefault("services.gc.maxAge", 0)
+	viper.SetDefault("services.gc.maxSize", 0)
 	viper.SetDefault("services.database.file", "db.sqlite3")
-	viper.SetConfigFile(*configFilePath)
+	viper.SetDefault("webhooks.outgoing.retries", 10)
+	viper.SetDefault("outbound.retries", 2)
+	viper.SetDefault("outbound.retryDelay", 500)
+	viper.SetDefault("outbound.breaker.failures", 5)
+	viper.SetDefault("outbound.breaker.cooldown", 30)
+	viper.SetDefault("outbound.operations.sync.timeout", 20)
+	viper.SetDefault("outbound.operations.mirror.timeout", 30)
+	viper.SetDefault("outbound.operations.zipball.timeout", 60)
+	viper.SetDefault("proxy.unknownHosts", "tunnel")
+	viper.SetDefault("proxy.cache.enabled", true)
+	viper.SetDefault("proxy.cache.timeout", 10)
+	viper.SetDefault("proxy.cache.maxSize", 10<<20)
+	viper.SetDefault("services.registry.hosts", []string{"package.elm-lang.org"})
+	viper.SetDefault("ca.cert", "./ca.crt")
+	viper.SetDefault("ca.key", "./ca.key")
+	viper.SetDefault("ca.autoGenerate", false)
+	viper.SetDefault("ca.keyType", "ecdsa")
+	viper.SetDefault("ca.validityDays", 3650)
+	viper.SetDefault("ca.commonName", "Elm Package Proxy CA")
+	viper.SetConfigFile(path)
 	viper.SetConfigType("yaml")
 
 	orPanic(viper.ReadInConfig())
 
+	// Set logging
+	log.SetFormatter(&log.JSONFormatter{})
+	level, err := log.ParseLevel(viper.GetString("global.logLevel"))
+	orPanic(err)
+	log.SetLevel(level)
+}
+
+// Generates the CA certificate & key configured under ca
+//
+func initCA(args []string) {
+	fs := flag.NewFlagSet("init-ca", flag.ExitOnError)
+	force := fs.Bool("force", false, "Overwrite an existing CA")
+	fs.Parse(args)
+
+	certPath := viper.GetString("ca.cert")
+	keyPath := viper.GetString("ca.key")
+	if _, err := os.Stat(certPath); err == nil && !*force {
+		log.Fatalf("A CA already exists at %s, use -force to overwrite it.", certPath)
+	}
+	orPanic(elmproxy.GenerateCA(certPath, keyPath))
+	log.Infof("Generated CA at %s and %s", certPath, keyPath)
+}
+
+// Compares the full upstream registry with the database, adding missing packages
+//
+func reconcile() {
+	orPanic(elmproxy.Open())
+	report, err := elmproxy.Reconcile()
+	orPanic(err)
+	b, err := json.MarshalIndent(report, "", "  ")
+	orPanic(err)
+	fmt.Println(string(b))
+}
+
+// Scrubs the stored package files, exiting with 1 when issues remain
+//
+func verify(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	repair := fs.Bool("repair", false, "Repair issues where possible")
+	fs.Parse(args)
+
+	orPanic(elmproxy.Open())
+	report, err := elmproxy.Scrub(*repair)
+	orPanic(err)
+	b, err := json.MarshalIndent(report, "", "  ")
+	orPanic(err)
+	fmt.Println(string(b))
+	if report.Unresolved() > 0 {
+		os.Exit(1)
+	}
+}
+
+// Evicts cached responses according to services.gc
+//
+func collectGarbage(args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Report what would be evicted without removing it")
+	fs.Parse(args)
+
+	orPanic(elmproxy.Open())
+	report, err := elmproxy.CollectGarbage(*dryRun)
+	orPanic(err)
+	b, err := json.MarshalIndent(report, "", "  ")
+	orPanic(err)
+	fmt.Println(string(b))
+}
+
+// Writes a backup archive, printing what it holds
+//
+func backup(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	out := fs.String("out", fmt.Sprintf("elm-package-proxy-%s.tar.gz", time.Now().UTC().Format("20060102-150405")), "Archive to write")
+	since := fs.Uint64("since", 0, "Only back up packages after this ID, the until of the previous backup")
+	fs.Parse(args)
+
+	orPanic(elmproxy.Open())
+	// Holds tokens & the CA key
+	f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	orPanic(err)
+	info, err := elmproxy.Backup(f, *since)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(*out)
+		orPanic(err)
+	}
+	b, err := json.MarshalIndent(info, "", "  ")
+	orPanic(err)
+	fmt.Println(string(b))
+	log.Infof("Wrote backup to %s", *out)
+}
+
+// Restores a backup, writing its config to the config path when none exists
+//
+func restore(configPath string, args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	force := fs.Bool("force", false, "Overwrite an existing database & CA")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: restore [-force] archive")
+		os.Exit(2)
+	}
+
+	f, err := os.Open(fs.Arg(0))
+	orPanic(err)
+	defer f.Close()
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		config, err := elmproxy.BackupConfig(f)
+		orPanic(err)
+		if config == nil {
+			log.Fatalf("%s does not exist and the backup has no config", configPath)
+		}
+		orPanic(ioutil.WriteFile(configPath, config, 0600))
+		log.Infof("Restored config to %s", configPath)
+		_, err = f.Seek(0, io.SeekStart)
+		orPanic(err)
+	}
+	loadConfig(configPath)
+	info, err := elmproxy.Restore(f, *force)
+	orPanic(err)
+	b, err := json.MarshalIndent(info, "", "  ")
+	orPanic(err)
+	fmt.Println(string(b))
+}
+
+// Writes a bundle of an application's dependencies or the given packages
+//
+func exportBundle(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("out", "bundle.tar.gz", "Bundle to write")
+	elmJson := fs.String("elm-json", "", "Application elm.json to bundle the dependencies of")
+	fs.Parse(args)
+	if *elmJson == "" && fs.NArg() == 0 {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: export [-out file] [-elm-json path] [author/name[@version]...]")
+		os.Exit(2)
+	}
+
+	orPanic(elmproxy.Open())
+	var app []byte
+	if *elmJson != "" {
+		var err error
+		app, err = ioutil.ReadFile(*elmJson)
+		orPanic(err)
+	}
+	f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	orPanic(err)
+	bundle, err := elmproxy.ExportBundle(f, app, fs.Args())
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(*out)
+		log.Fatal(err)
+	}
+	log.Infof("Wrote %d package(s) to %s", len(bundle.Packages), *out)
+}
+
+// Imports a bundle into the registry, a running proxy lists the new packages
+// after its next restart, see POST /admin/bundles to import into one.
+//
+func importBundle(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: import bundle")
+		os.Exit(2)
+	}
+
+	orPanic(elmproxy.Open())
+	f, err := os.Open(fs.Arg(0))
+	orPanic(err)
+	defer f.Close()
+	report, err := elmproxy.ImportBundle(f, "cli", "")
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	orPanic(err)
+	fmt.Println(string(b))
+}
+
+// Imports the package cache of ELM_HOME, ~/.elm by default
+//
+func importElmHome(args []string) {
+	fs := flag.NewFlagSet("import-elm-home", flag.ExitOnError)
+	offline := fs.Bool("offline", false, "Only compare archives with pinned registry hashes, without fetching any")
+	fs.Parse(args)
+	dir := fs.Arg(0)
+	if dir == "" {
+		if dir = os.Getenv("ELM_HOME"); dir == "" {
+			home, err := os.UserHomeDir()
+			orPanic(err)
+			dir = filepath.Join(home, ".elm")
+		}
+	}
+
+	orPanic(elmproxy.Open())
+	report, err := elmproxy.ImportElmHome(dir, *offline, "cli")
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := json.MarshalIndent(report, "", "  ")
+	orPanic(err)
+	fmt.Println(string(b))
+}
+
+func serve() {
 	proxyAddr := viper.GetString("services.proxy")
 	apiAddr := viper.GetString("services.api")
-	logLevel := viper.GetString("global.logLevel")
 
 	// Signals
 	done := make(chan os.Signal, 1)
 	signal.Notify(done, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	// Set logging
-	log.SetFormatter(&log.JSONFormatter{})
-	level, err := log.ParseLevel(logLevel)
-	orPanic(err)
-	log.SetLevel(level)
-
 	// Retrieve certs
-	// TODO CU-wndcr3: Overwrite certificate store to only provide package.elm-lang.org certificate
-	caCert, err := ioutil.ReadFile("./ca.crt")
-	orPanic(err)
-	caKey, err := ioutil.ReadFile("./ca.key")
+	caCert, caKey, err := elmproxy.LoadCA()
 	orPanic(err)
 	orPanic(setCA(caCert, caKey))
 
 	log.Info("Initializing...")
 	err = elmproxy.Initialize()
 	orPanic(err)
+	elmproxy.WatchConfig()
 
 	// Initializing Sync worker
 	mux := elmproxy.ProxyHandler()
 	ctx, cancel := context.WithCancel(context.Background())
 	go elmproxy.SyncWorker(ctx)
+	go elmproxy.WebhookWorker(ctx)
+	go elmproxy.RecheckWorker(ctx)
+	go elmproxy.ScrubWorker(ctx)
+	go elmproxy.GCWorker(ctx)
 
 	// Proxy setup
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Logger = &NopLogger{}
-	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile("^.*$"))).
-		HandleConnect(goproxy.AlwaysMitm)
+	proxy.Tr, err = elmproxy.OutboundTransport()
+	orPanic(err)
+	proxy.ConnectDial, err = elmproxy.OutboundConnectDial(proxy)
+	orPanic(err)
+	proxy.OnRequest().HandleConnectFunc(elmproxy.ConnectPolicy)
 	proxy.OnRequest(goproxy.ReqHostMatches(regexp.MustCompile("^.*$"))).DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		log.Debugf("%s - %s%s", r.Method, r.URL.Host, r.URL.Path)
 		return r, nil
 	})
+	// Unhandled registry routes fall back to cached responses when the upstream fails
+	cache := elmproxy.StaleCache(proxy.Tr)
 	proxy.OnRequest(goproxy.DstHostIs("package.elm-lang.org:443")).DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
 		if resp := mux(r); resp != nil {
 			return r, resp
 		}
-
+		ctx.RoundTripper = goproxy.RoundTripperFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+			return cache.RoundTrip(r)
+		})
 		return r, nil
 		//return r, goproxy.NewResponse(r, goproxy.ContentTypeText, 500, "")
 	})
 	proxy.OnRequest(goproxy.DstHostIs("api.github.com:443")).DoFunc(addGithubToken)
-	proxy.OnRequest(goproxy.DstHostIs("github.com:443")).DoFunc(addGithubToken)
+	// Archives of bundled packages are served without reaching github
+	archives := elmproxy.ArchiveHandler()
+	proxy.OnRequest(goproxy.DstHostIs("github.com:443")).DoFunc(func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if resp := archives(r); resp != nil {
+			return r, resp
+		}
+		return addGithubToken(r, ctx)
+	})
 	/*
 		proxy.OnResponse(goproxy.ReqHostMatches(regexp.MustCompile("^.*$"))).DoFunc(func(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
 			log.Debug(resp.Request.MultipartForm)
@@ -104,6 +402,8 @@ func main() {
 	srv := &http.Server{
 		Addr:    apiAddr,
 		Handler: elmproxy.Router(),
+		// Long lived requests such as /events end with the workers
+		BaseContext: func(net.Listener) context.Context { return ctx },
 	}
 	log.Printf("Starting API Server on %s", apiAddr)
 	go func() {
@@ -111,15 +411,37 @@ func main() {
 			log.Fatal("API server unexpected close. ", err)
 		}
 	}()
+	var registrySrv *http.Server
+	if registryAddr := viper.GetString("services.registry.addr"); registryAddr != "" {
+		leaf, err := elmproxy.LeafCertificate(&goproxy.GoproxyCa, viper.GetStringSlice("services.registry.hosts"))
+		orPanic(err)
+		registrySrv = &http.Server{
+			Addr:        registryAddr,
+			Handler:     elmproxy.RegistryHandler(),
+			TLSConfig:   &tls.Config{Certificates: []tls.Certificate{*leaf}},
+			BaseContext: func(net.Listener) context.Context { return ctx },
+		}
+		log.Printf("Starting Registry Server on %s", registryAddr)
+		go func() {
+			if err := registrySrv.ListenAndServeTLS("", ""); err != nil && err != http.ErrServerClosed {
+				log.Fatal("Registry server unexpected close. ", err)
+			}
+		}()
+	}
 	<-done
 	cancel()
-	ctx, can := context.WithTimeout(context.Background(), 10*time.Second)
+	shutdownCtx, can := context.WithTimeout(context.Background(), 10*time.Second)
 	defer func() {
 		can()
 	}()
-	if err := srv.Shutdown(ctx); err != nil {
+	if err := srv.Shutdown(shutdownCtx); err != nil {
 		log.Fatalf("API shutdown failed: %+v", err)
 	}
+	if registrySrv != nil {
+		if err := registrySrv.Shutdown(shutdownCtx); err != nil {
+			log.Fatalf("Registry shutdown failed: %+v", err)
+		}
+	}
 }
 
 func setCA(caCert, caKey []byte) error {